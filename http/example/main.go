@@ -4,16 +4,26 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sunliang711/goutils/http/middleware"
 	"github.com/sunliang711/goutils/http/server"
+	"github.com/sunliang711/goutils/log"
 )
 
 func main() {
-	httpServer := server.NewHttpServer(server.WithPort(9001))
+	httpServer := server.NewHttpServer(server.WithPort(9001), server.WithReadHeaderTimeout(5*time.Second), server.WithShutdownDelay(5*time.Second), server.WithGinDefaults(false))
 
-	httpServer.AddMiddlewares(nil)
+	logger := log.New(log.WithLevel("info"))
+	httpServer.AddMiddlewares([]server.Middleware{
+		{Name: "request-id", Handler: middleware.RequestId()},
+		{Name: "access-log", Handler: middleware.AccessLog(logger)},
+		{Name: "recovery", Handler: middleware.Recovery(logger)},
+		{Name: "rate-limit", Handler: middleware.RateLimit(middleware.Rate{Limit: 100, Window: time.Minute})},
+	})
 	httpServer.AddHealthHandler()
+	httpServer.AddReadyHandler()
 
 	err := httpServer.AddRoutes([]server.Routes{
 		{
@@ -41,7 +51,9 @@ func main() {
 		})
 	})
 
-	httpServer.Start()
+	if err := httpServer.Start(); err != nil {
+		panic(err)
+	}
 
 	// wait signal
 	osSignal := make(chan os.Signal, 1)
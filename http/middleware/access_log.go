@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunliang711/goutils/log"
+)
+
+// AccessLog 请求结束后通过logger记录一条结构化的访问日志
+// 字段: method path status latency bytes client_ip request_id，放在RequestId之后才有request_id
+// 5xx使用Error级别，4xx使用Warn级别，其他使用Info级别，logger的级别需要设置为info才能记录所有请求
+// logger为nil时使用info级别输出到标准输出的logger
+func AccessLog(logger *log.Logger) gin.HandlerFunc {
+	if logger == nil {
+		logger = log.New(log.WithLevel("info"))
+	}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		if c.Request.URL.RawQuery != "" {
+			path = path + "?" + c.Request.URL.RawQuery
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		entry := logger.
+			With("method", c.Request.Method).
+			With("path", path).
+			With("status", strconv.Itoa(status)).
+			With("latency", time.Since(start).String()).
+			With("bytes", strconv.Itoa(c.Writer.Size())).
+			With("client_ip", c.ClientIP()).
+			With("request_id", c.GetString(ContextKeyRequestId))
+		if len(c.Errors) > 0 {
+			entry = entry.With("errors", c.Errors.String())
+		}
+
+		switch {
+		case status >= http.StatusInternalServerError:
+			entry.Error("access")
+		case status >= http.StatusBadRequest:
+			entry.Warn("access")
+		default:
+			entry.Info("access")
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunliang711/goutils/http/types"
+)
+
+// BodyLimit 限制请求body的大小，Content-Length超过maxBytes时直接返回413
+// 没有Content-Length(chunked)时读取超过maxBytes后返回*http.MaxBytesError，并且关闭连接
+func BodyLimit(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, types.Response{
+				Code: types.CodeGeneralError,
+				Msg:  fmt.Sprintf("request body too large, limit: %d bytes", maxBytes),
+				Data: nil,
+			})
+			return
+		}
+
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		}
+		c.Next()
+	}
+}
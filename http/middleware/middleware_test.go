@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunliang711/goutils/http/types"
+	"github.com/sunliang711/goutils/log"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestRequestIdAccessLogRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(log.WithLevel("info"), log.WithWriter(&buf))
+
+	engine := gin.New()
+	engine.Use(RequestId(), AccessLog(logger), Recovery(logger))
+	engine.GET("/ok", func(c *gin.Context) {
+		c.String(http.StatusOK, GetRequestId(c.Request.Context()))
+	})
+	engine.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	// 使用请求中的request id
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ok", nil)
+	req.Header.Set(HeaderRequestId, "req-1")
+	engine.ServeHTTP(w, req)
+	if w.Body.String() != "req-1" || w.Header().Get(HeaderRequestId) != "req-1" {
+		t.Fatalf("request id: %s %s", w.Body.String(), w.Header().Get(HeaderRequestId))
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("access log: %s %v", buf.String(), err)
+	}
+	if entry["method"] != "GET" || entry["path"] != "/ok" || entry["status"] != "200" || entry["request_id"] != "req-1" || entry["bytes"] != "5" {
+		t.Fatalf("access log: %v", entry)
+	}
+
+	// panic时返回json，并生成request id
+	buf.Reset()
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	var resp types.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusInternalServerError || resp.Code != types.CodeGeneralError || resp.RequestId == "" || resp.RequestId != w.Header().Get(HeaderRequestId) {
+		t.Fatalf("recovery: %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(buf.String(), `"status":"500"`) {
+		t.Fatalf("access log of panic: %s", buf.String())
+	}
+
+	// logger为nil时使用默认的logger
+	engine = gin.New()
+	engine.Use(AccessLog(nil), Recovery(nil))
+	engine.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("nil logger: %d", w.Code)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	engine := gin.New()
+	engine.POST("/", BodyLimit(4), func(c *gin.Context) {
+		if _, err := c.GetRawData(); err != nil {
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		c.String(http.StatusOK, "ok")
+	})
+
+	for body, code := range map[string]int{"1234": http.StatusOK, "12345": http.StatusRequestEntityTooLarge} {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if w.Code != code {
+			t.Fatalf("body: %s code: %d", body, w.Code)
+		}
+	}
+
+	// 没有Content-Length时读取超过限制返回error
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("123456"))
+	req.ContentLength = -1
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked body: %d", w.Code)
+	}
+}
@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/sunliang711/goutils/http/types"
+	"github.com/sunliang711/goutils/http/utils"
+)
+
+type RateAlgorithm int
+
+const (
+	TokenBucket   RateAlgorithm = iota // 令牌桶，容量为Limit，每Window补满，允许突发
+	SlidingWindow                      // 滑动窗口，任意Window时间内最多Limit个请求(按前一个窗口的请求数加权估算)
+)
+
+// Rate 限流规则，例如 Rate{Limit: 100, Window: time.Minute} 表示每分钟100个请求
+type Rate struct {
+	Algorithm RateAlgorithm
+	Limit     int
+	Window    time.Duration
+}
+
+// RateResult 一次请求的限流结果
+type RateResult struct {
+	Allowed    bool
+	Remaining  int           // 剩余的请求数量
+	RetryAfter time.Duration // 不允许时多久之后可以重试
+	Reset      time.Duration // 多久之后配额完全恢复
+}
+
+// RateLimitStore 保存每个key的限流状态，Take需要是原子的
+type RateLimitStore interface {
+	// Take 为key消耗一个请求的配额
+	Take(ctx context.Context, key string, rate Rate) (RateResult, error)
+}
+
+// rateState 限流状态，零值表示没有请求过
+// 令牌桶使用Tokens和UpdatedAt，滑动窗口使用WindowStart、Count和PrevCount
+type rateState struct {
+	Tokens      float64
+	UpdatedAt   time.Time
+	WindowStart time.Time
+	Count       int
+	PrevCount   int
+}
+
+// take 根据算法更新state，返回本次请求的结果
+func (r Rate) take(state *rateState, now time.Time) RateResult {
+	if r.Algorithm == SlidingWindow {
+		return r.takeWindow(state, now)
+	}
+	return r.takeToken(state, now)
+}
+
+func (r Rate) takeToken(state *rateState, now time.Time) RateResult {
+	limit := float64(r.Limit)
+	perToken := r.Window / time.Duration(r.Limit) // 生成一个令牌的时间
+
+	if state.UpdatedAt.IsZero() {
+		state.Tokens = limit
+	} else if elapsed := now.Sub(state.UpdatedAt); elapsed > 0 {
+		state.Tokens = math.Min(limit, state.Tokens+float64(elapsed)/float64(perToken))
+	}
+	state.UpdatedAt = now
+
+	result := RateResult{Allowed: state.Tokens >= 1}
+	if result.Allowed {
+		state.Tokens--
+	} else {
+		result.RetryAfter = time.Duration((1 - state.Tokens) * float64(perToken))
+	}
+	result.Remaining = int(state.Tokens)
+	result.Reset = time.Duration((limit - state.Tokens) * float64(perToken))
+	return result
+}
+
+func (r Rate) takeWindow(state *rateState, now time.Time) RateResult {
+	window := r.Window
+	limit := float64(r.Limit)
+	current := now.Truncate(window)
+
+	if !state.WindowStart.Equal(current) {
+		if state.WindowStart.Equal(current.Add(-window)) {
+			state.PrevCount = state.Count
+		} else {
+			state.PrevCount = 0
+		}
+		state.Count = 0
+		state.WindowStart = current
+	}
+
+	elapsed := now.Sub(current)
+	// 前一个窗口的请求按和当前滑动窗口重叠的比例计算
+	weight := 1 - float64(elapsed)/float64(window)
+	estimated := float64(state.PrevCount)*weight + float64(state.Count)
+
+	result := RateResult{Allowed: estimated+1 <= limit}
+	if result.Allowed {
+		state.Count++
+		estimated++
+	} else if state.Count+1 <= r.Limit {
+		// 等待前一个窗口的请求滑出: PrevCount * (1 - t/window) + Count + 1 <= Limit
+		t := float64(window) * (1 - (limit-float64(state.Count)-1)/float64(state.PrevCount))
+		result.RetryAfter = time.Duration(t) - elapsed
+	} else {
+		// 当前窗口已满，等到下一个窗口中当前窗口的请求滑出
+		t := float64(window) * (1 - (limit-1)/float64(state.Count))
+		result.RetryAfter = window - elapsed + time.Duration(t)
+	}
+
+	result.Remaining = int(math.Max(0, limit-math.Ceil(estimated)))
+	switch {
+	case state.Count > 0:
+		result.Reset = 2*window - elapsed
+	case state.PrevCount > 0:
+		result.Reset = window - elapsed
+	}
+	return result
+}
+
+// KeyFunc 返回限流的key，返回空字符串时使用客户端IP
+type KeyFunc func(c *gin.Context) string
+
+// KeyByIP 按客户端IP限流，使用gin的ClientIP，需要通过gin.Engine.SetTrustedProxies设置可信的代理
+func KeyByIP() KeyFunc {
+	return func(c *gin.Context) string {
+		return "ip:" + c.ClientIP()
+	}
+}
+
+// KeyByAPIKey 按请求头header中的API key限流，key保存为sha256，没有该请求头时按IP限流
+func KeyByAPIKey(header string) KeyFunc {
+	return func(c *gin.Context) string {
+		apiKey := c.GetHeader(header)
+		if apiKey == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(apiKey))
+		return "apikey:" + hex.EncodeToString(sum[:16])
+	}
+}
+
+// KeyByJwtClaim 按Authorization中jwt token的claim限流，例如用户id，token无效或者没有该claim时按IP限流
+func KeyByJwtClaim(secret, claim string) KeyFunc {
+	return func(c *gin.Context) string {
+		token := c.Request.Header.Get(jwtHeaderName)
+		if token == "" {
+			return ""
+		}
+		parsedToken, err := utils.ParseJwtToken(token, secret)
+		if err != nil {
+			return ""
+		}
+		claims, ok := parsedToken.Claims.(jwt.MapClaims)
+		if !ok || claims[claim] == nil {
+			return ""
+		}
+		return "jwt:" + fmt.Sprint(claims[claim])
+	}
+}
+
+type rateLimitOptions struct {
+	store    RateLimitStore
+	keyFunc  KeyFunc
+	name     string
+	perRoute bool
+}
+
+type RateLimitOption func(*rateLimitOptions)
+
+// WithRateLimitStore 设置保存限流状态的store，默认为容量10000的MemoryRateLimitStore
+// 多实例部署时使用SQLRateLimitStore
+func WithRateLimitStore(store RateLimitStore) RateLimitOption {
+	return func(o *rateLimitOptions) {
+		o.store = store
+	}
+}
+
+// WithRateLimitKey 设置限流的key，默认为KeyByIP
+func WithRateLimitKey(keyFunc KeyFunc) RateLimitOption {
+	return func(o *rateLimitOptions) {
+		o.keyFunc = keyFunc
+	}
+}
+
+// WithRateLimitName 设置key的前缀，多个限流中间件共用一个store时需要设置不同的名称
+func WithRateLimitName(name string) RateLimitOption {
+	return func(o *rateLimitOptions) {
+		o.name = name
+	}
+}
+
+// WithRateLimitPerRoute 每个路由(方法和路径模板)单独计数，作为全局中间件时每个路由使用相同的Rate
+func WithRateLimitPerRoute(perRoute bool) RateLimitOption {
+	return func(o *rateLimitOptions) {
+		o.perRoute = perRoute
+	}
+}
+
+// RateLimit 限流中间件，超过限制时返回429和Retry-After，所有响应都带有X-RateLimit-Limit、
+// X-RateLimit-Remaining和X-RateLimit-Reset(秒)
+// 放到Handler.Middlewares中可以为单个路由设置不同的Rate
+// store出错时不限流，错误通过c.Error记录，AccessLog会输出
+func RateLimit(rate Rate, opts ...RateLimitOption) gin.HandlerFunc {
+	options := rateLimitOptions{
+		keyFunc: KeyByIP(),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.store == nil {
+		options.store = NewMemoryRateLimitStore(10000)
+	}
+	if rate.Limit <= 0 || rate.Window <= 0 {
+		panic(fmt.Sprintf("invalid rate limit: %d per %v", rate.Limit, rate.Window))
+	}
+
+	ipKey := KeyByIP()
+	return func(c *gin.Context) {
+		key := options.keyFunc(c)
+		if key == "" {
+			key = ipKey(c)
+		}
+		if options.perRoute {
+			key = c.Request.Method + " " + c.FullPath() + "|" + key
+		}
+		if options.name != "" {
+			key = options.name + "|" + key
+		}
+
+		result, err := options.store.Take(c.Request.Context(), key, rate)
+		if err != nil {
+			c.Error(fmt.Errorf("rate limit: %s error: %w", key, err))
+			c.Next()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(rate.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.Itoa(max(1, ceilSeconds(result.RetryAfter))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, types.Response{
+				RequestId: c.GetString(ContextKeyRequestId),
+				Code:      types.CodeGeneralError,
+				Msg:       "too many requests",
+				Data:      nil,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RateLimitRecord SQLRateLimitStore使用的表，可以放到db.DatabaseConfig.Tables中由db.Database迁移
+type RateLimitRecord struct {
+	Key         string `gorm:"column:limit_key;primaryKey;size:255"`
+	Tokens      float64
+	UpdatedAt   *time.Time `gorm:"autoUpdateTime:false"`
+	WindowStart *time.Time
+	Count       int
+	PrevCount   int
+	ExpiresAt   *time.Time `gorm:"index"` // 超过该时间后状态和没有请求过相同，可以删除
+}
+
+func (RateLimitRecord) TableName() string {
+	return "http_rate_limit"
+}
+
+// SQLRateLimitStore 基于数据库的RateLimitStore，多个实例共享限流状态
+// 每次请求在一个事务中用SELECT ... FOR UPDATE读取并更新状态，db通过db.Database.GetDatabase获取
+type SQLRateLimitStore struct {
+	db *gorm.DB
+}
+
+func NewSQLRateLimitStore(db *gorm.DB) *SQLRateLimitStore {
+	return &SQLRateLimitStore{db: db}
+}
+
+// Migrate 创建表，已经通过db.Database迁移时不需要调用
+func (s *SQLRateLimitStore) Migrate() error {
+	if err := s.db.AutoMigrate(&RateLimitRecord{}); err != nil {
+		return fmt.Errorf("migrate table: %s error: %w", RateLimitRecord{}.TableName(), err)
+	}
+	return nil
+}
+
+func (s *SQLRateLimitStore) Take(ctx context.Context, key string, rate Rate) (RateResult, error) {
+	var result RateResult
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// 先插入没有状态的记录，保证并发的第一次请求也能锁住同一行
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&RateLimitRecord{Key: key}).Error
+		if err != nil {
+			return err
+		}
+
+		var record RateLimitRecord
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("limit_key = ?", key).
+			Take(&record).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		var state rateState
+		// 新插入的记录和过期但还没有被Purge的记录当作没有请求过
+		if record.ExpiresAt != nil && now.Before(*record.ExpiresAt) {
+			state = rateState{
+				Tokens:      record.Tokens,
+				UpdatedAt:   timeValue(record.UpdatedAt),
+				WindowStart: timeValue(record.WindowStart),
+				Count:       record.Count,
+				PrevCount:   record.PrevCount,
+			}
+		}
+		result = rate.take(&state, now)
+
+		return tx.Model(&RateLimitRecord{}).
+			Where("limit_key = ?", key).
+			Updates(map[string]any{
+				"tokens":       state.Tokens,
+				"updated_at":   nullTime(state.UpdatedAt),
+				"window_start": nullTime(state.WindowStart),
+				"count":        state.Count,
+				"prev_count":   state.PrevCount,
+				"expires_at":   now.Add(result.Reset),
+			}).Error
+	})
+	if err != nil {
+		return result, fmt.Errorf("take rate limit error: %w", err)
+	}
+	return result, nil
+}
+
+// Purge 删除已经过期的记录，返回删除的数量，需要定期调用
+func (s *SQLRateLimitStore) Purge(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).
+		Where("expires_at <= ?", time.Now()).
+		Delete(&RateLimitRecord{})
+	return result.RowsAffected, result.Error
+}
+
+// nullTime 零值保存为NULL，避免MySQL不支持的0000-00-00
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func timeValue(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryRateLimitStore 内存中的RateLimitStore，超过容量时淘汰最久没有请求的key
+// 只在单个进程内有效，多实例部署时使用SQLRateLimitStore
+type MemoryRateLimitStore struct {
+	mux      sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type memoryRateEntry struct {
+	key   string
+	state rateState
+}
+
+// NewMemoryRateLimitStore capacity为最多保存的key数量，小于等于0时不限制
+func NewMemoryRateLimitStore(capacity int) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rate Rate) (RateResult, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	elem, ok := s.entries[key]
+	if ok {
+		s.lru.MoveToFront(elem)
+	} else {
+		elem = s.lru.PushFront(&memoryRateEntry{key: key})
+		s.entries[key] = elem
+		for s.capacity > 0 && s.lru.Len() > s.capacity {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.entries, oldest.Value.(*memoryRateEntry).key)
+		}
+	}
+
+	return rate.take(&elem.Value.(*memoryRateEntry).state, time.Now()), nil
+}
+
+// Len 返回保存的key数量
+func (s *MemoryRateLimitStore) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.lru.Len()
+}
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestTokenBucket(t *testing.T) {
+	rate := Rate{Algorithm: TokenBucket, Limit: 2, Window: 2 * time.Second}
+	now := time.Now()
+	var state rateState
+
+	for i := 0; i < 2; i++ {
+		if result := rate.take(&state, now); !result.Allowed {
+			t.Fatalf("request %d denied", i)
+		}
+	}
+	result := rate.take(&state, now)
+	if result.Allowed || result.RetryAfter != time.Second || result.Remaining != 0 {
+		t.Fatalf("third request: %+v", result)
+	}
+
+	// 1秒生成一个令牌
+	if result = rate.take(&state, now.Add(time.Second)); !result.Allowed || result.Reset != 2*time.Second {
+		t.Fatalf("after refill: %+v", result)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	rate := Rate{Algorithm: SlidingWindow, Limit: 4, Window: time.Minute}
+	start := time.Now().Truncate(time.Minute)
+	var state rateState
+
+	for i := 0; i < 4; i++ {
+		if result := rate.take(&state, start); !result.Allowed {
+			t.Fatalf("request %d denied", i)
+		}
+	}
+	// 当前窗口已满，下一个窗口中前一个窗口的权重降到3/4后才允许
+	result := rate.take(&state, start.Add(30*time.Second))
+	if result.Allowed || result.RetryAfter != 45*time.Second {
+		t.Fatalf("full window: %+v", result)
+	}
+	if result = rate.take(&state, start.Add(time.Minute+10*time.Second)); result.Allowed {
+		t.Fatalf("previous window still weighted: %+v", result)
+	}
+	if result = rate.take(&state, start.Add(time.Minute+15*time.Second)); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("after slide: %+v", result)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	engine := gin.New()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	store := NewMemoryRateLimitStore(100)
+	limit := RateLimit(Rate{Limit: 1, Window: time.Minute}, WithRateLimitStore(store), WithRateLimitKey(KeyByAPIKey("X-Api-Key")), WithRateLimitPerRoute(true))
+	engine.GET("/a", limit, ok)
+	engine.GET("/b", limit, ok)
+
+	serve := func(path, apiKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		engine.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("/a", "k1"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "1" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("first request: %d %v", w.Code, w.Header())
+	}
+	w := serve("/a", "k1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("limited request: %d %v", w.Code, w.Header())
+	}
+	// 不同的路由和不同的API key分别计数
+	if w = serve("/b", "k1"); w.Code != http.StatusOK {
+		t.Fatalf("other route: %d", w.Code)
+	}
+	if w = serve("/a", "k2"); w.Code != http.StatusOK {
+		t.Fatalf("other api key: %d", w.Code)
+	}
+	if store.Len() != 3 {
+		t.Fatalf("store keys: %d", store.Len())
+	}
+}
+
+func TestSQLRateLimitStore(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewSQLRateLimitStore(db)
+	if err = store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, rate := range []Rate{{Algorithm: TokenBucket, Limit: 2, Window: time.Minute}, {Algorithm: SlidingWindow, Limit: 2, Window: time.Minute}} {
+		key := "ip:127.0.0.1:" + strconv.Itoa(int(rate.Algorithm))
+		for i, allowed := range []bool{true, true, false} {
+			result, err := store.Take(ctx, key, rate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed != allowed {
+				t.Fatalf("algorithm: %d request %d: %+v", rate.Algorithm, i, result)
+			}
+		}
+	}
+
+	// 过期的记录当作没有请求过
+	rate := Rate{Limit: 1, Window: time.Millisecond}
+	store.Take(ctx, "expired", rate)
+	time.Sleep(2 * time.Millisecond)
+	if result, err := store.Take(ctx, "expired", rate); err != nil || !result.Allowed {
+		t.Fatalf("expired: %+v %v", result, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if purged, err := store.Purge(ctx); err != nil || purged != 1 {
+		t.Fatalf("purge: %d %v", purged, err)
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunliang711/goutils/http/types"
+	"github.com/sunliang711/goutils/log"
+)
+
+// Recovery handler panic时记录日志和堆栈，返回500和types.Response格式的json
+// 客户端已经断开(broken pipe)时只记录日志，logger为nil时使用默认的logger
+func Recovery(logger *log.Logger) gin.HandlerFunc {
+	if logger == nil {
+		logger = log.New()
+	}
+
+	return func(c *gin.Context) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+
+			requestId := c.GetString(ContextKeyRequestId)
+			logger.With("method", c.Request.Method).
+				With("path", c.Request.URL.Path).
+				With("request_id", requestId).
+				Error("handler panic: %v\n%s", v, debug.Stack())
+
+			if err, ok := v.(error); ok && isBrokenPipe(err) {
+				c.Abort()
+				return
+			}
+			// 已经写入了响应头时无法再修改状态码
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+
+			c.AbortWithStatusJSON(http.StatusInternalServerError, types.Response{
+				RequestId: requestId,
+				Code:      types.CodeGeneralError,
+				Msg:       "internal server error",
+				Data:      nil,
+			})
+		}()
+
+		c.Next()
+	}
+}
+
+// isBrokenPipe 客户端断开导致写入失败
+func isBrokenPipe(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	var syscallErr *os.SyscallError
+	if errors.As(opErr, &syscallErr) {
+		return errors.Is(syscallErr.Err, syscall.EPIPE) || errors.Is(syscallErr.Err, syscall.ECONNRESET)
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// HeaderRequestId 请求和响应中的request id头
+	HeaderRequestId = "X-Request-Id"
+	// ContextKeyRequestId gin.Context中保存request id的key
+	ContextKeyRequestId = "requestId"
+
+	maxRequestIdLength = 128
+)
+
+type requestIdKey struct{}
+
+// RequestId 读取请求头X-Request-Id，没有或者超过128个字符时生成一个新的，
+// 保存到gin.Context和c.Request.Context()中，并写入响应头
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader(HeaderRequestId)
+		if requestId == "" || len(requestId) > maxRequestIdLength {
+			requestId = newRequestId()
+		}
+
+		c.Set(ContextKeyRequestId, requestId)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIdKey{}, requestId))
+		c.Header(HeaderRequestId, requestId)
+		c.Next()
+	}
+}
+
+// GetRequestId 返回RequestId保存的request id，ctx可以是*gin.Context或者c.Request.Context()
+func GetRequestId(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok {
+		return c.GetString(ContextKeyRequestId)
+	}
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -2,17 +2,25 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/sunliang711/goutils/http/middleware"
 
 	swagFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type HttpServer struct {
@@ -32,6 +40,18 @@ type HttpServer struct {
 	routes []Routes
 
 	customFuncs []CustomFunc
+
+	tls          tlsOptions
+	certReloader *certReloader
+	unixSocket   string
+
+	// Start失败后可以再次调用，已经完成的设置不会重复
+	engineConfigured bool
+	routesConfigured bool
+
+	shutdownTimeout time.Duration
+	shutdownDelay   time.Duration
+	ready           atomic.Bool
 }
 
 type serverOptions struct {
@@ -40,6 +60,20 @@ type serverOptions struct {
 	enableSwag bool
 	enableCors bool
 	corsConfig cors.Config
+	tls        tlsOptions
+	h2c        bool
+	unixSocket string
+
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	maxBodyBytes      int64
+	shutdownTimeout   time.Duration
+	shutdownDelay     time.Duration
+
+	ginDefaults bool
 }
 type ServerOption func(*serverOptions)
 
@@ -73,6 +107,116 @@ func WithCorsConfig(corsConfig cors.Config) ServerOption {
 	}
 }
 
+// WithTLS 使用https，certFile和keyFile为PEM格式的证书和私钥文件
+func WithTLS(certFile, keyFile string) ServerOption {
+	return func(o *serverOptions) {
+		o.tls.certFile = certFile
+		o.tls.keyFile = keyFile
+	}
+}
+
+// WithTLSConfig 使用https，config中需要设置证书，和WithTLS同时使用时在config的基础上加载证书文件
+func WithTLSConfig(config *tls.Config) ServerOption {
+	return func(o *serverOptions) {
+		o.tls.config = config
+	}
+}
+
+// WithClientAuth 双向认证(mTLS)，使用clientCAFile中的CA验证客户端证书，clientAuth通常为tls.RequireAndVerifyClientCert
+// 需要同时使用WithTLS或WithTLSConfig，否则Start返回error
+func WithClientAuth(clientCAFile string, clientAuth tls.ClientAuthType) ServerOption {
+	return func(o *serverOptions) {
+		o.tls.clientCAFile = clientCAFile
+		o.tls.clientAuth = clientAuth
+	}
+}
+
+// WithCertReload WithTLS的证书或私钥文件变化时重新加载，不需要重启服务
+func WithCertReload(reload bool) ServerOption {
+	return func(o *serverOptions) {
+		o.tls.reload = reload
+	}
+}
+
+// WithH2C 不使用TLS时支持HTTP/2(h2c)，使用TLS时自动支持HTTP/2
+func WithH2C(enableH2C bool) ServerOption {
+	return func(o *serverOptions) {
+		o.h2c = enableH2C
+	}
+}
+
+// WithUnixSocket 监听unix socket，设置后忽略host和port，启动时删除遗留的socket文件
+func WithUnixSocket(path string) ServerOption {
+	return func(o *serverOptions) {
+		o.unixSocket = path
+	}
+}
+
+// WithGinDefaults 是否使用gin.Logger()和gin.Recovery()，默认为true
+// 设置为false后可以使用middleware.RequestId、middleware.AccessLog和middleware.Recovery代替
+func WithGinDefaults(enable bool) ServerOption {
+	return func(o *serverOptions) {
+		o.ginDefaults = enable
+	}
+}
+
+// WithReadTimeout 读取整个请求(包括body)的超时时间，为0时不限制
+func WithReadTimeout(timeout time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.readTimeout = timeout
+	}
+}
+
+// WithReadHeaderTimeout 读取请求头的超时时间，为0时使用ReadTimeout
+func WithReadHeaderTimeout(timeout time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.readHeaderTimeout = timeout
+	}
+}
+
+// WithWriteTimeout 从读取完请求头到写完响应的超时时间，为0时不限制
+func WithWriteTimeout(timeout time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.writeTimeout = timeout
+	}
+}
+
+// WithIdleTimeout keep-alive连接等待下一个请求的超时时间，为0时使用ReadTimeout
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.idleTimeout = timeout
+	}
+}
+
+// WithMaxHeaderBytes 请求头的最大字节数，为0时使用http.DefaultMaxHeaderBytes(1MB)
+func WithMaxHeaderBytes(maxHeaderBytes int) ServerOption {
+	return func(o *serverOptions) {
+		o.maxHeaderBytes = maxHeaderBytes
+	}
+}
+
+// WithMaxBodyBytes 所有请求body的最大字节数，超过时返回413，为0时不限制
+// 单个路由可以使用middleware.BodyLimit设置不同的限制
+func WithMaxBodyBytes(maxBodyBytes int64) ServerOption {
+	return func(o *serverOptions) {
+		o.maxBodyBytes = maxBodyBytes
+	}
+}
+
+// WithShutdownTimeout Stop等待正在处理的请求结束的最长时间，默认10秒
+func WithShutdownTimeout(timeout time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.shutdownTimeout = timeout
+	}
+}
+
+// WithShutdownDelay 停止时先把readiness设置为不可用，等待delay让负载均衡摘除流量后再关闭监听，默认为0
+func WithShutdownDelay(delay time.Duration) ServerOption {
+	return func(o *serverOptions) {
+		o.shutdownDelay = delay
+	}
+}
+
 // func NewHttpServer(host string, port int, enableSwag, enableCors bool, corsConfig cors.Config) *HttpServer {
 func NewHttpServer(options ...ServerOption) *HttpServer {
 	defaultOptions := &serverOptions{
@@ -81,6 +225,9 @@ func NewHttpServer(options ...ServerOption) *HttpServer {
 		enableSwag: false,
 		enableCors: false,
 		corsConfig: cors.Config{},
+
+		shutdownTimeout: 10 * time.Second,
+		ginDefaults:     true,
 	}
 
 	for _, opt := range options {
@@ -88,7 +235,9 @@ func NewHttpServer(options ...ServerOption) *HttpServer {
 	}
 
 	ginEngine := gin.New()
-	ginEngine.Use(gin.Logger(), gin.Recovery())
+	if defaultOptions.ginDefaults {
+		ginEngine.Use(gin.Logger(), gin.Recovery())
+	}
 
 	if defaultOptions.host == "" {
 		defaultOptions.host = "0.0.0.0"
@@ -96,19 +245,38 @@ func NewHttpServer(options ...ServerOption) *HttpServer {
 
 	addr := fmt.Sprintf("%s:%d", defaultOptions.host, defaultOptions.port)
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: ginEngine,
+		Addr:              addr,
+		Handler:           ginEngine,
+		ReadTimeout:       defaultOptions.readTimeout,
+		ReadHeaderTimeout: defaultOptions.readHeaderTimeout,
+		WriteTimeout:      defaultOptions.writeTimeout,
+		IdleTimeout:       defaultOptions.idleTimeout,
+		MaxHeaderBytes:    defaultOptions.maxHeaderBytes,
+	}
+	if defaultOptions.h2c {
+		srv.Handler = h2c.NewHandler(ginEngine, &http2.Server{})
 	}
 
-	return &HttpServer{
+	s := &HttpServer{
 		server:     srv,
 		gin:        ginEngine,
 		logger:     log.New(os.Stdout, "|HTTP_SERVER| ", log.LstdFlags),
 		enableSwag: defaultOptions.enableSwag,
 		enableCors: defaultOptions.enableCors,
 		corsConfig: defaultOptions.corsConfig,
+		tls:        defaultOptions.tls,
+		unixSocket: defaultOptions.unixSocket,
 		// jwtSecret:  jwtSecret,
+
+		shutdownTimeout: defaultOptions.shutdownTimeout,
+		shutdownDelay:   defaultOptions.shutdownDelay,
 	}
+
+	if defaultOptions.maxBodyBytes > 0 {
+		s.AddMiddlewares([]Middleware{{Name: "body-limit", Handler: middleware.BodyLimit(defaultOptions.maxBodyBytes)}})
+	}
+
+	return s
 }
 
 func (s *HttpServer) setupSwag() {
@@ -145,6 +313,27 @@ func (s *HttpServer) setupMiddlewares() {
 	}
 }
 
+// anyMethods MethodAny对应的HTTP方法，和gin的RouterGroup.Any相同
+var anyMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodHead, http.MethodOptions, http.MethodDelete, http.MethodConnect,
+	http.MethodTrace,
+}
+
+// routeMethods 返回Handler.Method对应的HTTP方法，不支持的方法返回nil
+func routeMethods(method string) []string {
+	method = strings.ToUpper(method)
+	if method == MethodAny {
+		return anyMethods
+	}
+	for _, m := range anyMethods {
+		if m == method {
+			return []string{m}
+		}
+	}
+	return nil
+}
+
 func (s *HttpServer) AddRoutes(routes []Routes) error {
 	// check handlers
 	for _, r := range routes {
@@ -152,6 +341,9 @@ func (s *HttpServer) AddRoutes(routes []Routes) error {
 			if h.Method == "" {
 				return fmt.Errorf("method is empty")
 			}
+			if routeMethods(h.Method) == nil {
+				return fmt.Errorf("handler: %s path: %s unsupported method: %s", h.Name, h.Path, h.Method)
+			}
 			if h.Handler == nil {
 				return fmt.Errorf("handler is nil")
 			}
@@ -165,7 +357,12 @@ func (s *HttpServer) AddRoutes(routes []Routes) error {
 	return nil
 }
 
-func (s *HttpServer) setupRoutes() {
+// setupRoutes 注册路由，相同方法和路径的路由重复注册时返回error
+func (s *HttpServer) setupRoutes() error {
+	// 先检查所有路由，有冲突时不注册任何路由
+	if err := s.validateRoutes(); err != nil {
+		return err
+	}
 
 	for _, routes := range s.routes {
 		group := s.gin.Group(routes.GroupPath)
@@ -181,29 +378,114 @@ func (s *HttpServer) setupRoutes() {
 			// 添加handler
 			middlewaresAndHandler = append(middlewaresAndHandler, handler.Handler)
 
-			switch handler.Method {
-			case http.MethodPost:
-				group.POST(handler.Path, middlewaresAndHandler...)
-			case http.MethodGet:
-				group.GET(handler.Path, middlewaresAndHandler...)
-			case http.MethodPut:
-				group.PUT(handler.Path, middlewaresAndHandler...)
-			case http.MethodDelete:
-				group.DELETE(handler.Path, middlewaresAndHandler...)
-			default:
-				s.logger.Printf("setup routes: unsupport HTTP method: %s", handler.Method)
+			if err := handleRoute(group, handler.Method, handler.Path, middlewaresAndHandler...); err != nil {
+				return fmt.Errorf("setup routes: handler: %s error: %w", handler.Name, err)
 			}
 		}
 	}
+
+	return nil
+}
+
+// validateRoutes 检查重复的路由，并在一个临时的gin.Engine中注册所有路由，检查gin报告的冲突(例如通配符冲突)
+func (s *HttpServer) validateRoutes() error {
+	// 已经注册的路由，key为 "方法 路径"，value为handler名称
+	registered := make(map[string]string)
+	scratch := gin.New()
+	noop := func(*gin.Context) {}
+	for _, route := range s.gin.Routes() {
+		registered[route.Method+" "+route.Path] = route.Handler
+		scratch.Handle(route.Method, route.Path, noop)
+	}
+
+	for _, routes := range s.routes {
+		group := scratch.Group(routes.GroupPath)
+		for _, handler := range routes.Handlers {
+			fullPath := joinPaths(group.BasePath(), handler.Path)
+			for _, method := range routeMethods(handler.Method) {
+				key := method + " " + fullPath
+				if name, ok := registered[key]; ok {
+					return fmt.Errorf("setup routes: %s of handler: %s already registered by: %s", key, handler.Name, name)
+				}
+				registered[key] = handler.Name
+			}
+
+			if err := handleRoute(group, handler.Method, handler.Path, noop); err != nil {
+				return fmt.Errorf("setup routes: handler: %s error: %w", handler.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// handleRoute 注册路由，把gin注册时的panic(例如通配符冲突)转换为error
+func handleRoute(group *gin.RouterGroup, method, relativePath string, handlers ...gin.HandlerFunc) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("register %s %s: %v", method, relativePath, v)
+		}
+	}()
+
+	method = strings.ToUpper(method)
+	if method == MethodAny {
+		group.Any(relativePath, handlers...)
+	} else {
+		group.Handle(method, relativePath, handlers...)
+	}
+	return nil
 }
 
-func (s *HttpServer) start() {
-	s.logger.Printf("start http server on: %s", s.server.Addr)
+// joinPaths 和gin拼接group路径的方式相同，保留末尾的/
+func joinPaths(absolutePath, relativePath string) string {
+	if relativePath == "" {
+		return absolutePath
+	}
+
+	finalPath := path.Join(absolutePath, relativePath)
+	if strings.HasSuffix(relativePath, "/") && !strings.HasSuffix(finalPath, "/") {
+		return finalPath + "/"
+	}
+	return finalPath
+}
+
+// listen 监听tcp地址或者unix socket
+func (s *HttpServer) listen() (net.Listener, error) {
+	if s.unixSocket == "" {
+		return net.Listen("tcp", s.server.Addr)
+	}
+
+	// 删除上次没有正常退出时遗留的socket文件，不是socket的文件不删除
+	if info, err := os.Lstat(s.unixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(s.unixSocket); err != nil {
+			return nil, fmt.Errorf("remove unix socket: %s error: %w", s.unixSocket, err)
+		}
+	}
+	return net.Listen("unix", s.unixSocket)
+}
+
+// start 先监听，监听失败时返回error，成功后在后台处理请求
+func (s *HttpServer) start() error {
+	ln, err := s.listen()
+	if err != nil {
+		return fmt.Errorf("listen error: %w", err)
+	}
+
+	s.logger.Printf("start http server on: %s", ln.Addr())
+	s.ready.Store(true)
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			panic(fmt.Sprintf("listen: %s\n", err))
+		var err error
+		if s.server.TLSConfig != nil {
+			err = s.server.ServeTLS(ln, "", "")
+		} else {
+			err = s.server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Printf("serve error: %v", err)
 		}
 	}()
+
+	return nil
 }
 
 // add health handler
@@ -223,6 +505,47 @@ func (s *HttpServer) AddHealthHandler() {
 	}})
 }
 
+// AddReadyHandler 添加readiness接口，启动后返回200，Stop开始后返回503
+// 和health接口不同，负载均衡根据该接口判断是否继续发送流量
+func (s *HttpServer) AddReadyHandler() {
+	s.AddRoutes([]Routes{{
+		GroupPath: "/api/v1",
+		Handlers: []Handler{
+			{
+				Name:   "ready",
+				Method: "GET",
+				Path:   "/ready",
+				Handler: func(c *gin.Context) {
+					if !s.Ready() {
+						c.String(http.StatusServiceUnavailable, "not ready")
+						return
+					}
+					c.String(http.StatusOK, "ok")
+				},
+			},
+		},
+	}})
+}
+
+// Ready 是否可以接收流量，Start成功后为true，Stop开始后为false
+func (s *HttpServer) Ready() bool {
+	return s.ready.Load()
+}
+
+// AddMetricsHandler 添加指标接口，例如rmq.PrometheusMetrics的Handler()
+func (s *HttpServer) AddMetricsHandler(path string, handler http.Handler) {
+	s.AddRoutes([]Routes{{
+		Handlers: []Handler{
+			{
+				Name:    "metrics",
+				Method:  "GET",
+				Path:    path,
+				Handler: gin.WrapH(handler),
+			},
+		},
+	}})
+}
+
 func (s *HttpServer) AddCustomFunc(f CustomFunc) {
 	s.customFuncs = append(s.customFuncs, f)
 }
@@ -233,33 +556,70 @@ func (s *HttpServer) executeCustomFunc() {
 	}
 }
 
-func (s *HttpServer) Start() error {
-	// 设置跨域
-	s.setupCors()
+// Start 设置路由并开始监听，监听失败(例如端口被占用)时返回error
+func (s *HttpServer) Start() (err error) {
+	// 加载证书
+	if err = s.setupTLS(); err != nil {
+		return err
+	}
+	// 启动失败时停止监听证书文件
+	defer func() {
+		if err != nil {
+			s.closeCertReloader()
+		}
+	}()
+
+	if !s.engineConfigured {
+		// 设置跨域
+		s.setupCors()
 
-	// 设置中间件
-	s.setupMiddlewares()
+		// 设置中间件
+		s.setupMiddlewares()
 
-	// 设置swagger
-	s.setupSwag()
+		// 设置swagger
+		s.setupSwag()
 
-	// 设置路由
-	s.setupRoutes()
+		s.engineConfigured = true
+	}
 
-	// 自定义函数
-	s.executeCustomFunc()
+	if !s.routesConfigured {
+		// 设置路由
+		if err = s.setupRoutes(); err != nil {
+			return err
+		}
 
-	// 启动服务
-	s.start()
+		// 自定义函数
+		s.executeCustomFunc()
 
-	return nil
+		s.routesConfigured = true
+	}
+
+	// 启动服务
+	return s.start()
 }
 
+// Stop 优雅关闭，最多等待WithShutdownTimeout设置的时间
 func (s *HttpServer) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	return s.Shutdown(ctx)
+}
+
+// Shutdown 优雅关闭，先把readiness设置为不可用，等待WithShutdownDelay设置的时间后
+// 关闭监听并等待正在处理的请求结束，直到ctx超时或取消
+func (s *HttpServer) Shutdown(ctx context.Context) error {
 	s.logger.Printf("shutdown http server")
+	s.ready.Store(false)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	if s.shutdownDelay > 0 {
+		select {
+		case <-time.After(s.shutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	s.closeCertReloader()
 
 	// 优雅关闭服务
 	err := s.server.Shutdown(ctx)
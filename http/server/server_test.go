@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestSetupRoutesMethods(t *testing.T) {
+	s := NewHttpServer()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, c.Request.Method) }
+
+	err := s.AddRoutes([]Routes{{
+		GroupPath: "/api",
+		Handlers: []Handler{
+			{Name: "patch", Method: "patch", Path: "/orders/:id", Handler: ok},
+			{Name: "head", Method: http.MethodHead, Path: "/orders", Handler: ok},
+			{Name: "any", Method: MethodAny, Path: "/echo", Handler: ok},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddRoutes([]Routes{{Handlers: []Handler{{Method: "FETCH", Path: "/", Handler: ok}}}}); err == nil {
+		t.Fatal("unsupported method should fail")
+	}
+	if err = s.setupRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ method, path string }{
+		{http.MethodPatch, "/api/orders/1"},
+		{http.MethodHead, "/api/orders"},
+		{http.MethodOptions, "/api/echo"},
+		{http.MethodTrace, "/api/echo"},
+	} {
+		w := httptest.NewRecorder()
+		s.gin.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: %d", c.method, c.path, w.Code)
+		}
+	}
+}
+
+func TestSetupRoutesConflict(t *testing.T) {
+	s := NewHttpServer()
+	ok := func(c *gin.Context) {}
+
+	s.AddRoutes([]Routes{
+		{GroupPath: "/api", Handlers: []Handler{{Name: "any", Method: MethodAny, Path: "/orders", Handler: ok}}},
+		{Handlers: []Handler{{Name: "create", Method: http.MethodPost, Path: "/api/orders", Handler: ok}}},
+	})
+	err := s.setupRoutes()
+	if err == nil || !strings.Contains(err.Error(), "POST /api/orders") {
+		t.Fatalf("duplicate route: %v", err)
+	}
+	// 有冲突时不注册任何路由
+	if routes := s.gin.Routes(); len(routes) != 0 {
+		t.Fatalf("registered routes: %v", routes)
+	}
+
+	// gin注册时的panic转换为error
+	s = NewHttpServer()
+	s.AddRoutes([]Routes{{Handlers: []Handler{
+		{Name: "files", Method: http.MethodGet, Path: "/files/*path", Handler: ok},
+		{Name: "file", Method: http.MethodGet, Path: "/files/:name", Handler: ok},
+	}}})
+	if err = s.setupRoutes(); err == nil {
+		t.Fatal("wildcard conflict should fail")
+	}
+	if routes := s.gin.Routes(); len(routes) != 0 {
+		t.Fatalf("registered routes: %v", routes)
+	}
+}
+
+func TestStartListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := NewHttpServer(WithHost("127.0.0.1"), WithPort(ln.Addr().(*net.TCPAddr).Port))
+	s.AddHealthHandler()
+	if err = s.Start(); err == nil {
+		s.Stop()
+		t.Fatal("listen on used port should fail")
+	}
+
+	// 再次Start只重试监听，不重复注册路由和中间件
+	handlers := len(s.gin.Handlers)
+	if err = s.Start(); err == nil || !strings.Contains(err.Error(), "listen") {
+		t.Fatalf("retry start: %v", err)
+	}
+	if len(s.gin.Handlers) != handlers {
+		t.Fatalf("middlewares: %d want %d", len(s.gin.Handlers), handlers)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "http.sock")
+	s := NewHttpServer(WithUnixSocket(socket))
+	s.AddHealthHandler()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://unix/api/v1/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Fatalf("health: %s", body)
+	}
+}
+
+func TestShutdownReadiness(t *testing.T) {
+	s := NewHttpServer(WithHost("127.0.0.1"), WithPort(0), WithMaxBodyBytes(8), WithShutdownDelay(50*time.Millisecond))
+	s.AddReadyHandler()
+	s.AddRoutes([]Routes{{Handlers: []Handler{{Name: "echo", Method: http.MethodPost, Path: "/echo", Handler: func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	}}}}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		s.gin.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+	if code := serve(http.MethodGet, "/api/v1/ready", ""); code != http.StatusOK {
+		t.Fatalf("ready: %d", code)
+	}
+	if code := serve(http.MethodPost, "/echo", "0123456789"); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("body limit: %d", code)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// 等待期间readiness已经不可用
+	if code := serve(http.MethodGet, "/api/v1/ready", ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("ready during shutdown: %d", code)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
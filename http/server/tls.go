@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type tlsOptions struct {
+	certFile     string
+	keyFile      string
+	config       *tls.Config
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+	reload       bool
+}
+
+// enabled 设置了证书文件或者tls.Config时使用https
+func (o *tlsOptions) enabled() bool {
+	return o.certFile != "" || o.config != nil
+}
+
+// setupTLS 加载证书和客户端CA，设置http.Server.TLSConfig
+// 没有证书或者没有启用TLS却设置了客户端CA时返回error，避免启动后才失败或者静默地不验证客户端
+func (s *HttpServer) setupTLS() error {
+	options := s.tls
+	if !options.enabled() {
+		if options.clientCAFile != "" {
+			return fmt.Errorf("client ca: %s error: tls not enabled", options.clientCAFile)
+		}
+		return nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if options.config != nil {
+		config = options.config.Clone()
+	}
+
+	if options.certFile != "" {
+		if options.reload {
+			reloader, err := newCertReloader(options.certFile, options.keyFile, s.logger)
+			if err != nil {
+				return err
+			}
+			s.certReloader = reloader
+			config.GetCertificate = reloader.GetCertificate
+		} else {
+			cert, err := tls.LoadX509KeyPair(options.certFile, options.keyFile)
+			if err != nil {
+				return fmt.Errorf("load certificate: %s error: %w", options.certFile, err)
+			}
+			config.Certificates = append(config.Certificates, cert)
+		}
+	}
+
+	if options.clientCAFile != "" {
+		caCert, err := os.ReadFile(options.clientCAFile)
+		if err != nil {
+			s.closeCertReloader()
+			return fmt.Errorf("read client ca: %s error: %w", options.clientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			s.closeCertReloader()
+			return fmt.Errorf("parse client ca: %s error: no certificate found", options.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = options.clientAuth
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return fmt.Errorf("setup tls error: no certificate")
+	}
+
+	s.server.TLSConfig = config
+	return nil
+}
+
+// closeCertReloader 停止监听证书文件
+func (s *HttpServer) closeCertReloader() {
+	if s.certReloader != nil {
+		s.certReloader.close()
+	}
+}
+
+// certReloader 证书或私钥文件变化时重新加载，加载失败时继续使用原来的证书
+// 监听文件所在的目录，所以通过rename或者替换符号链接(例如kubernetes secret)更新的文件也能检测到
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *log.Logger
+
+	mux  sync.RWMutex
+	cert *tls.Certificate
+
+	watcher   *fsnotify.Watcher
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newCertReloader(certFile, keyFile string, logger *log.Logger) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create certificate watcher error: %w", err)
+	}
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("watch certificate dir: %s error: %w", dir, err)
+		}
+	}
+	c.watcher = watcher
+
+	go c.watch()
+	return c, nil
+}
+
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %s error: %w", c.certFile, err)
+	}
+
+	c.mux.Lock()
+	c.cert = &cert
+	c.mux.Unlock()
+	return nil
+}
+
+func (c *certReloader) watch() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			// 证书和私钥分别写入时，只写入一个文件时加载失败，等待另一个文件写入后再次加载
+			if err := c.load(); err != nil {
+				c.logger.Printf("reload certificate error: %v", err)
+				continue
+			}
+			c.logger.Printf("certificate reloaded: %s", c.certFile)
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			c.logger.Printf("watch certificate error: %v", err)
+		}
+	}
+}
+
+// GetCertificate 用于tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	return c.cert, nil
+}
+
+func (c *certReloader) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.watcher.Close()
+	})
+}
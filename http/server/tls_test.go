@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert 生成自签名证书，写入certFile和keyFile
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 先写到临时文件再rename，和证书管理工具更新证书的方式相同
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err = os.WriteFile(file+".tmp", pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(file+".tmp", file); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first")
+
+	s := NewHttpServer(WithTLS(certFile, keyFile), WithCertReload(true))
+	if err := s.setupTLS(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.certReloader.close()
+
+	commonName := func() string {
+		cert, err := s.server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if name := commonName(); name != "first" {
+		t.Fatalf("certificate: %s", name)
+	}
+
+	writeCert(t, certFile, keyFile, "second")
+	deadline := time.Now().Add(5 * time.Second)
+	for commonName() != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartErrorClosesCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first")
+
+	// 端口无效，监听失败
+	s := NewHttpServer(WithTLS(certFile, keyFile), WithCertReload(true), WithPort(-1))
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatal("want listen error")
+	}
+
+	select {
+	case <-s.certReloader.done:
+	default:
+		t.Fatal("certificate reloader not closed")
+	}
+}
+
+func TestSetupTLSErrors(t *testing.T) {
+	// tls.Config中没有证书
+	s := NewHttpServer(WithTLSConfig(&tls.Config{}))
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatal("want no certificate error")
+	}
+
+	// 没有启用TLS时设置客户端CA
+	s = NewHttpServer(WithClientAuth("ca.crt", tls.RequireAndVerifyClientCert))
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatal("want tls not enabled error")
+	}
+}
@@ -9,9 +9,12 @@ type Middleware struct {
 	Handler gin.HandlerFunc
 }
 
+// MethodAny Handler.Method为ANY时匹配所有HTTP方法
+const MethodAny = "ANY"
+
 type Handler struct {
 	Name   string
-	Method string
+	Method string // GET、POST、PUT、PATCH、DELETE、HEAD、OPTIONS、CONNECT、TRACE或ANY，不区分大小写
 	Path   string
 
 	Middlewares []gin.HandlerFunc
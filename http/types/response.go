@@ -8,7 +8,7 @@ const (
 )
 
 type Response struct {
-	// RequestId string `json:"requestId"`
+	RequestId string `json:"requestId,omitempty"`
 
 	// Success bool   `json:"success"`
 	Code Code   `json:"code"`
@@ -0,0 +1,16 @@
+package rmq
+
+// Broker RabbitMQ对外提供的生产、消费接口
+// 业务代码依赖Broker而不是*RabbitMQ时，测试中可以使用rmqtest.Broker代替真实的rabbitmq
+type Broker interface {
+	AddProducer(exchangeName string, exchangeOptions ExchangeOptions, defaults ...PublishOption) error
+	AddConsumer(exchangeName string, topic string, handler MessageHandlerFunc, queueOptions QueueOptions, consumeOptions ConsumeOptions) error
+	AddHandler(exchangeName string, topic string, handler HandlerFunc, queueOptions QueueOptions, consumeOptions ConsumeOptions) error
+	AddConsumerConfig(exchangeName string, config ConsumerConfig) error
+	Use(middlewares ...Middleware)
+	Connect() error
+	Publish(exchange, routingKey string, body []byte, opts ...PublishOption) error
+	Close()
+}
+
+var _ Broker = (*RabbitMQ)(nil)
@@ -0,0 +1,318 @@
+package rmq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrBufferFull 断线期间发送缓冲区已满
+var ErrBufferFull = errors.New("rabbitmq publish buffer full")
+
+// OverflowPolicy 发送缓冲区满时的处理方式
+type OverflowPolicy int
+
+const (
+	OverflowError      OverflowPolicy = iota // 返回ErrBufferFull
+	OverflowDropOldest                       // 丢弃最早的消息
+	OverflowBlock                            // 阻塞直到有空间或者Close
+)
+
+type bufferedMessage struct {
+	Exchange   string
+	RoutingKey string
+	Publishing amqp.Publishing
+}
+
+func init() {
+	// amqp.Table中的值为interface，gob需要注册具体类型，基本类型已经默认注册
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+	gob.Register(amqp.Decimal{})
+}
+
+// publishBuffer 断线期间缓存Publish的消息，重连后按顺序发送
+// spool非空时缓存的消息同时写入文件，进程重启后可以继续发送
+// spool文件中每条消息为4字节长度加gob编码，保留消息头中值的类型
+type publishBuffer struct {
+	size   int
+	policy OverflowPolicy
+	spool  string
+
+	mux      sync.Mutex
+	cond     *sync.Cond
+	messages []bufferedMessage
+	flushing bool // 正在发送，新消息需要放入缓冲区，保证顺序
+	stale    int  // OverflowDropOldest丢弃后仍然在spool文件开头的消息数量
+	closed   bool
+}
+
+func newPublishBuffer(size int, policy OverflowPolicy, spool string) (*publishBuffer, error) {
+	b := &publishBuffer{
+		size:   size,
+		policy: policy,
+		spool:  spool,
+	}
+	b.cond = sync.NewCond(&b.mux)
+
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// isDisconnected 发送失败是否因为连接断开
+func isDisconnected(err error) bool {
+	return errors.Is(err, ErrNotConnected) || errors.Is(err, amqp.ErrClosed)
+}
+
+// publish 缓冲区为空时直接发送，连接断开或者缓冲区非空(保证顺序)时放入缓冲区
+// 发送时不持有锁，多个goroutine可以同时发送
+func (b *publishBuffer) publish(msg bufferedMessage, publish func(bufferedMessage) error) error {
+	b.mux.Lock()
+	if len(b.messages) == 0 && !b.flushing {
+		b.mux.Unlock()
+		err := publish(msg)
+		if err == nil || !isDisconnected(err) {
+			return err
+		}
+		b.mux.Lock()
+	}
+	defer b.mux.Unlock()
+
+	return b.push(msg)
+}
+
+// pending 缓冲区中的消息数量
+func (b *publishBuffer) pending() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return len(b.messages)
+}
+
+func (b *publishBuffer) push(msg bufferedMessage) error {
+	for len(b.messages) >= b.size {
+		if b.closed {
+			return ErrNotConnected
+		}
+
+		switch b.policy {
+		case OverflowDropOldest:
+			// 不重写spool文件，丢弃的消息累计到size条时再重写
+			b.messages = b.messages[1:]
+			b.stale++
+		case OverflowBlock:
+			b.cond.Wait()
+		default:
+			return ErrBufferFull
+		}
+	}
+
+	b.messages = append(b.messages, msg)
+	if err := b.append(msg); err != nil {
+		// 没有写入spool文件时不放入缓冲区，调用方重试时不会重复
+		b.messages = b.messages[:len(b.messages)-1]
+		// 写入失败可能留下不完整的记录，重写文件，正在flush时由flush结束时重写
+		if !b.flushing {
+			b.save()
+		}
+		return err
+	}
+
+	if b.stale >= b.size && !b.flushing {
+		// 消息已经写入，重写失败时下次再重写
+		b.save()
+	}
+	return nil
+}
+
+// flush 按顺序发送缓冲区中的消息，连接断开时停止，剩余的消息等待下次flush
+// 因为其他原因发送失败的消息调用onError后丢弃，避免阻塞后面的消息
+// 发送时不持有锁，期间Publish的消息放入缓冲区，本次flush继续发送，其他goroutine同时flush时直接返回
+func (b *publishBuffer) flush(publish func(bufferedMessage) error, onError func(bufferedMessage, error)) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.flushing || len(b.messages) == 0 {
+		return 0, nil
+	}
+	b.flushing = true
+
+	sent := 0
+	var err error
+	for len(b.messages) > 0 && err == nil {
+		batch := b.messages
+		b.messages = nil
+		b.cond.Broadcast()
+		b.mux.Unlock()
+
+		i := 0
+		for ; i < len(batch); i++ {
+			if err = publish(batch[i]); err != nil {
+				if isDisconnected(err) {
+					break
+				}
+				onError(batch[i], err)
+				err = nil
+			} else {
+				sent++
+			}
+		}
+
+		b.mux.Lock()
+		// 没有发送的消息放回缓冲区开头
+		if i < len(batch) {
+			b.messages = append(batch[i:len(batch):len(batch)], b.messages...)
+		}
+	}
+	b.flushing = false
+
+	if saveErr := b.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+
+	return sent, err
+}
+
+// close 唤醒阻塞的Publish
+func (b *publishBuffer) close() {
+	b.mux.Lock()
+	b.closed = true
+	b.mux.Unlock()
+	b.cond.Broadcast()
+}
+
+// load 读取spool文件中的消息，文件末尾不完整的记录(写入时进程退出)被忽略
+// 消息数量超过size时，OverflowDropOldest保留最新的size条，其他策略返回error
+func (b *publishBuffer) load() error {
+	if b.spool == "" {
+		return nil
+	}
+
+	f, err := os.Open(b.spool)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open spool file: %s error: %w", b.spool, err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		msg, err := readSpoolRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("decode spool file: %s error: %w", b.spool, err)
+		}
+		b.messages = append(b.messages, msg)
+	}
+
+	if over := len(b.messages) - b.size; over > 0 {
+		if b.policy != OverflowDropOldest {
+			return fmt.Errorf("spool file: %s has %d messages, more than buffer size: %d", b.spool, len(b.messages), b.size)
+		}
+		b.messages = b.messages[over:]
+		b.stale = over
+	}
+	return nil
+}
+
+// append 追加一条消息到spool文件
+func (b *publishBuffer) append(msg bufferedMessage) error {
+	if b.spool == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(b.spool, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open spool file: %s error: %w", b.spool, err)
+	}
+
+	if err = writeSpoolRecord(f, msg); err != nil {
+		f.Close()
+		return fmt.Errorf("write spool file: %s error: %w", b.spool, err)
+	}
+	return f.Close()
+}
+
+// save 用缓冲区中的消息重写spool文件
+func (b *publishBuffer) save() error {
+	if b.spool == "" {
+		return nil
+	}
+
+	tmp := b.spool + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create spool file: %s error: %w", tmp, err)
+	}
+
+	writer := bufio.NewWriter(f)
+	for _, msg := range b.messages {
+		if err = writeSpoolRecord(writer, msg); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, b.spool); err != nil {
+		return err
+	}
+	b.stale = 0
+	return nil
+}
+
+// writeSpoolRecord 写入一条记录，每条记录单独编码，追加写入的记录可以独立解码
+func writeSpoolRecord(w io.Writer, msg bufferedMessage) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return err
+	}
+
+	record := buf.Bytes()
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	_, err := w.Write(record)
+	return err
+}
+
+func readSpoolRecord(r io.Reader) (bufferedMessage, error) {
+	var msg bufferedMessage
+
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return msg, err
+	}
+	record := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return msg, err
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(record)).Decode(&msg)
+	return msg, err
+}
@@ -0,0 +1,208 @@
+package rmq
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func bufferedKeys(b *publishBuffer) []string {
+	var keys []string
+	for _, msg := range b.messages {
+		keys = append(keys, msg.RoutingKey)
+	}
+	return keys
+}
+
+func disconnected(bufferedMessage) error {
+	return ErrNotConnected
+}
+
+func TestPublishBufferOverflow(t *testing.T) {
+	b, _ := newPublishBuffer(2, OverflowError, "")
+	for _, key := range []string{"a", "b"} {
+		if err := b.publish(bufferedMessage{RoutingKey: key}, disconnected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.publish(bufferedMessage{RoutingKey: "c"}, disconnected); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("got %v want ErrBufferFull", err)
+	}
+
+	b, _ = newPublishBuffer(2, OverflowDropOldest, "")
+	for _, key := range []string{"a", "b", "c"} {
+		if err := b.publish(bufferedMessage{RoutingKey: key}, disconnected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := bufferedKeys(b); len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Fatalf("got %v want [b c]", got)
+	}
+}
+
+func TestPublishBufferFlushOrder(t *testing.T) {
+	b, _ := newPublishBuffer(10, OverflowError, "")
+	for _, key := range []string{"a", "b", "c"} {
+		b.publish(bufferedMessage{RoutingKey: key}, disconnected)
+	}
+
+	// 第二条消息发送时断开
+	var sent []string
+	publish := func(msg bufferedMessage) error {
+		if len(sent) == 1 {
+			return amqp.ErrClosed
+		}
+		sent = append(sent, msg.RoutingKey)
+		return nil
+	}
+	n, err := b.flush(publish, nil)
+	if n != 1 || err == nil {
+		t.Fatalf("got sent: %d err: %v", n, err)
+	}
+
+	// 缓冲区非空时新消息排在后面
+	b.publish(bufferedMessage{RoutingKey: "d"}, func(bufferedMessage) error { return nil })
+	if got := bufferedKeys(b); len(got) != 3 || got[0] != "b" || got[2] != "d" {
+		t.Fatalf("got %v want [b c d]", got)
+	}
+
+	sent = nil
+	n, err = b.flush(func(msg bufferedMessage) error {
+		sent = append(sent, msg.RoutingKey)
+		return nil
+	}, nil)
+	if n != 3 || err != nil || len(b.messages) != 0 {
+		t.Fatalf("got sent: %d err: %v remaining: %d", n, err, len(b.messages))
+	}
+}
+
+func TestPublishBufferSpool(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "rmq.spool")
+
+	b, _ := newPublishBuffer(10, OverflowError, spool)
+	for _, key := range []string{"a", "b"} {
+		msg := bufferedMessage{Exchange: "ex", RoutingKey: key, Publishing: amqp.Publishing{Body: []byte(key)}}
+		if err := b.publish(msg, disconnected); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 模拟进程重启
+	b, err := newPublishBuffer(10, OverflowError, spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bufferedKeys(b); len(got) != 2 || got[0] != "a" || string(b.messages[1].Publishing.Body) != "b" {
+		t.Fatalf("got %v want [a b]", got)
+	}
+
+	b.flush(func(bufferedMessage) error { return nil }, nil)
+	b, _ = newPublishBuffer(10, OverflowError, spool)
+	if len(b.messages) != 0 {
+		t.Fatalf("spool not truncated after flush: %v", bufferedKeys(b))
+	}
+}
+
+func TestPublishBufferUnlocked(t *testing.T) {
+	b, _ := newPublishBuffer(10, OverflowError, "")
+
+	// 发送时不持有锁
+	err := b.publish(bufferedMessage{RoutingKey: "a"}, func(bufferedMessage) error {
+		if !b.mux.TryLock() {
+			t.Fatal("buffer locked while publishing")
+		}
+		b.mux.Unlock()
+		return amqp.ErrClosed
+	})
+	if err != nil || b.pending() != 1 {
+		t.Fatalf("got err: %v pending: %d", err, b.pending())
+	}
+}
+
+func TestPublishBufferFlushUnlocked(t *testing.T) {
+	b, _ := newPublishBuffer(10, OverflowError, "")
+	b.publish(bufferedMessage{RoutingKey: "a"}, disconnected)
+
+	// 发送时不持有锁，期间Publish的消息放入缓冲区并在本次flush中发送
+	var sent []string
+	n, err := b.flush(func(msg bufferedMessage) error {
+		if !b.mux.TryLock() {
+			t.Fatal("buffer locked while flushing")
+		}
+		b.mux.Unlock()
+		if msg.RoutingKey == "a" {
+			b.publish(bufferedMessage{RoutingKey: "b"}, func(bufferedMessage) error {
+				t.Fatal("published while flushing")
+				return nil
+			})
+		}
+		sent = append(sent, msg.RoutingKey)
+		return nil
+	}, nil)
+	if n != 2 || err != nil || len(sent) != 2 || sent[1] != "b" || b.pending() != 0 {
+		t.Fatalf("got sent: %v err: %v pending: %d", sent, err, b.pending())
+	}
+}
+
+func TestPublishBufferSpoolHeaders(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "rmq.spool")
+
+	b, _ := newPublishBuffer(10, OverflowError, spool)
+	headers := amqp.Table{"count": int64(3), "raw": []byte{1, 2}, "nested": amqp.Table{"ok": true}}
+	b.publish(bufferedMessage{RoutingKey: "a", Publishing: amqp.Publishing{Headers: headers}}, disconnected)
+
+	b, err := newPublishBuffer(10, OverflowError, spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := b.messages[0].Publishing.Headers
+	if count, ok := got["count"].(int64); !ok || count != 3 {
+		t.Fatalf("count: %T %v", got["count"], got["count"])
+	}
+	if raw, ok := got["raw"].([]byte); !ok || len(raw) != 2 {
+		t.Fatalf("raw: %T %v", got["raw"], got["raw"])
+	}
+	if nested, ok := got["nested"].(amqp.Table); !ok || nested["ok"] != true {
+		t.Fatalf("nested: %T %v", got["nested"], got["nested"])
+	}
+}
+
+func TestPublishBufferSpoolLimit(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "rmq.spool")
+
+	// 丢弃的消息不立即重写文件，重新加载时保留最新的size条
+	b, _ := newPublishBuffer(3, OverflowDropOldest, spool)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		b.publish(bufferedMessage{RoutingKey: key}, disconnected)
+	}
+	if b.stale != 2 {
+		t.Fatalf("stale: %d", b.stale)
+	}
+	b, err := newPublishBuffer(3, OverflowDropOldest, spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bufferedKeys(b); len(got) != 3 || got[0] != "c" || got[2] != "e" {
+		t.Fatalf("got %v want [c d e]", got)
+	}
+
+	// 其他策略下消息数量超过size时返回error
+	if _, err = newPublishBuffer(2, OverflowError, spool); err == nil {
+		t.Fatal("want error for spool larger than buffer")
+	}
+}
+
+func TestPublishBufferSpoolError(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "missing", "rmq.spool")
+
+	// 写入spool失败时不放入缓冲区，重试不会重复
+	b, _ := newPublishBuffer(10, OverflowError, spool)
+	if err := b.publish(bufferedMessage{RoutingKey: "a"}, disconnected); err == nil {
+		t.Fatal("want spool error")
+	}
+	if b.pending() != 0 {
+		t.Fatalf("pending: %d", b.pending())
+	}
+}
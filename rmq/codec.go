@@ -0,0 +1,229 @@
+package rmq
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeText     = "text/plain"
+)
+
+// Codec 消息体的编解码，根据消息的ContentType选择
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+	TextCodec     Codec = textCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// textCodec 不编码，用于Publish默认的text/plain消息
+// 支持string、[]byte和实现了encoding.TextMarshaler/TextUnmarshaler的类型
+type textCodec struct{}
+
+func (textCodec) ContentType() string {
+	return ContentTypeText
+}
+
+func (textCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case encoding.TextMarshaler:
+		return v.MarshalText()
+	}
+	return nil, fmt.Errorf("%T is not a string, []byte or encoding.TextMarshaler", v)
+}
+
+func (textCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *string:
+		*v = string(data)
+		return nil
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+		return nil
+	case encoding.TextUnmarshaler:
+		return v.UnmarshalText(data)
+	}
+	return fmt.Errorf("%T is not a *string, *[]byte or encoding.TextUnmarshaler", v)
+}
+
+var (
+	codecs = map[string]Codec{
+		ContentTypeJSON:     JSONCodec,
+		ContentTypeProtobuf: ProtobufCodec,
+		ContentTypeMsgpack:  MsgpackCodec,
+		ContentTypeText:     TextCodec,
+	}
+	codecsMux sync.RWMutex
+)
+
+// RegisterCodec 注册codec，相同ContentType的codec会被覆盖
+func RegisterCodec(codec Codec) {
+	codecsMux.Lock()
+	defer codecsMux.Unlock()
+
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecFor 根据ContentType返回codec，ContentType为空时使用JSONCodec
+func CodecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSONCodec, nil
+	}
+
+	// 去掉charset等参数
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("parse content type: %s error: %w", contentType, err)
+	}
+
+	codecsMux.RLock()
+	defer codecsMux.RUnlock()
+
+	codec, ok := codecs[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("no codec for content type: %s", contentType)
+	}
+	return codec, nil
+}
+
+// PublishWithCodec 用codec编码v并发送，ContentType设置为codec.ContentType()
+func PublishWithCodec[T any](r Broker, codec Codec, exchange, routingKey string, v T, opts ...PublishOption) error {
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode message error: %w", err)
+	}
+
+	opts = append([]PublishOption{WithContentType(codec.ContentType())}, opts...)
+	return r.Publish(exchange, routingKey, body, opts...)
+}
+
+func PublishJSON[T any](r Broker, exchange, routingKey string, v T, opts ...PublishOption) error {
+	return PublishWithCodec(r, JSONCodec, exchange, routingKey, v, opts...)
+}
+
+func PublishProtobuf[T proto.Message](r Broker, exchange, routingKey string, v T, opts ...PublishOption) error {
+	return PublishWithCodec(r, ProtobufCodec, exchange, routingKey, v, opts...)
+}
+
+func PublishMsgpack[T any](r Broker, exchange, routingKey string, v T, opts ...PublishOption) error {
+	return PublishWithCodec(r, MsgpackCodec, exchange, routingKey, v, opts...)
+}
+
+// TypedHandlerFunc 接收解码后的消息，返回值的处理和HandlerFunc相同
+type TypedHandlerFunc[T any] func(ctx context.Context, v T, msg amqp.Delivery) error
+
+// Decode 根据消息的ContentType解码消息体
+// T为指针类型(例如protobuf消息)时会分配新的对象
+func Decode[T any](msg amqp.Delivery) (T, error) {
+	var v T
+
+	codec, err := CodecFor(msg.ContentType)
+	if err != nil {
+		return v, err
+	}
+
+	target := any(&v)
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Pointer {
+		v = reflect.New(t.Elem()).Interface().(T)
+		target = v
+	}
+
+	if err = codec.Unmarshal(msg.Body, target); err != nil {
+		return v, fmt.Errorf("decode message with content type: %s error: %w", codec.ContentType(), err)
+	}
+	return v, nil
+}
+
+// TypedHandler 把TypedHandlerFunc转换为HandlerFunc
+// 解码失败的消息nack且不重新入队，队列配置了死信时进入死信队列
+func TypedHandler[T any](handler TypedHandlerFunc[T]) HandlerFunc {
+	return func(ctx context.Context, msg amqp.Delivery) error {
+		v, err := Decode[T](msg)
+		if err != nil {
+			return Discard(err)
+		}
+		return handler(ctx, v, msg)
+	}
+}
+
+// AddTypedConsumer 添加消费者，消息根据ContentType解码为T后交给handler
+func AddTypedConsumer[T any](r Broker, exchangeName string, topic string, handler TypedHandlerFunc[T], queueOptions QueueOptions, consumeOptions ConsumeOptions) error {
+	if handler == nil {
+		return fmt.Errorf("exchange %s handler is nil", exchangeName)
+	}
+
+	return r.AddHandler(exchangeName, topic, TypedHandler(handler), queueOptions, consumeOptions)
+}
@@ -0,0 +1,80 @@
+package rmq
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type order struct {
+	Id     string `json:"id" msgpack:"id"`
+	Amount int    `json:"amount" msgpack:"amount"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		body, err := codec.Marshal(order{Id: "o1", Amount: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := Decode[order](amqp.Delivery{ContentType: codec.ContentType(), Body: body})
+		if err != nil || got.Id != "o1" || got.Amount != 10 {
+			t.Fatalf("%s: got %+v err: %v", codec.ContentType(), got, err)
+		}
+	}
+
+	body, err := ProtobufCodec.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode[*wrapperspb.StringValue](amqp.Delivery{ContentType: ContentTypeProtobuf, Body: body})
+	if err != nil || got.GetValue() != "hello" {
+		t.Fatalf("protobuf: got %v err: %v", got, err)
+	}
+}
+
+func TestTextCodec(t *testing.T) {
+	// Publish默认的ContentType为text/plain
+	msg := amqp.Delivery{ContentType: defaultContentType, Body: []byte("hello")}
+	if got, err := Decode[string](msg); err != nil || got != "hello" {
+		t.Fatalf("string: got %q err: %v", got, err)
+	}
+	if got, err := Decode[[]byte](msg); err != nil || string(got) != "hello" {
+		t.Fatalf("bytes: got %q err: %v", got, err)
+	}
+	if _, err := Decode[order](msg); err == nil {
+		t.Fatal("want error for struct")
+	}
+
+	body, err := TextCodec.Marshal("hello")
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("marshal: got %q err: %v", body, err)
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	codec, err := CodecFor("application/json; charset=utf-8")
+	if err != nil || codec != JSONCodec {
+		t.Fatalf("got %v err: %v", codec, err)
+	}
+
+	if _, err = CodecFor("application/unknown"); err == nil {
+		t.Fatal("want error for unknown content type")
+	}
+}
+
+func TestTypedHandlerDecodeError(t *testing.T) {
+	called := false
+	handler := TypedHandler(func(ctx context.Context, v order, msg amqp.Delivery) error {
+		called = true
+		return nil
+	})
+
+	err := handler(context.Background(), amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte("{")})
+	if requeue, explicit := nackDecision(err, NackRequeue); called || !explicit || requeue {
+		t.Fatalf("want discard without calling handler, got called: %v err: %v", called, err)
+	}
+}
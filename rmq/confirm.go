@@ -0,0 +1,99 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrNacked broker拒绝了消息(basic.nack)
+	ErrNacked = errors.New("message nacked by broker")
+	// ErrNotConnected 尚未连接或连接已断开
+	ErrNotConnected = errors.New("rabbitmq not connected")
+)
+
+// ReturnedError 消息以mandatory方式发送，但没有任何队列可以路由，被broker退回
+type ReturnedError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("message returned by broker: exchange: %s routing key: %s reply: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// PublishWithConfirm 以mandatory方式发送消息，并等待broker确认
+// 返回nil表示broker已经接收并路由了该消息
+// 消息无法路由时返回*ReturnedError，broker nack时返回ErrNacked
+// ctx超时或取消时返回ctx.Err()
+func (r *RabbitMQ) PublishWithConfirm(ctx context.Context, exchange, routingKey string, body []byte, opts ...PublishOption) error {
+	options := r.publishOptions(exchange, opts...)
+
+	err := r.publishWithConfirm(ctx, exchange, routingKey, options.Publishing(body))
+	r.metrics.Published(exchange, publishResult(err))
+	return err
+}
+
+func (r *RabbitMQ) publishWithConfirm(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	pool, err := r.publishPool(true)
+	if err != nil {
+		return err
+	}
+
+	// 取出的channel只被当前goroutine使用，使得退回的消息和本次发送一一对应
+	pc, err := pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.put(pc)
+
+	// 丢弃之前超时的发送遗留的退回消息
+	for len(pc.returns) > 0 {
+		<-pc.returns
+	}
+
+	confirm, err := pc.ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory
+		false,      // immediate
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ret, ok := <-pc.returns:
+		if ok {
+			return &ReturnedError{
+				Exchange:   ret.Exchange,
+				RoutingKey: ret.RoutingKey,
+				ReplyCode:  ret.ReplyCode,
+				ReplyText:  ret.ReplyText,
+			}
+		}
+	default:
+	}
+
+	if !acked {
+		// channel关闭时未确认的消息也会返回nack，例如exchange不存在
+		if pc.ch.IsClosed() {
+			return pool.closeError(pc)
+		}
+		return ErrNacked
+	}
+
+	return nil
+}
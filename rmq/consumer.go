@@ -0,0 +1,283 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// consumerRun 消费者在当前会话中的状态
+type consumerRun struct {
+	name        string
+	queue       string
+	consumerTag string
+	ch          *amqp.Channel
+	config      ConsumerConfig // Handler已经包装了中间件
+
+	stopping *atomic.Bool   // 本次消费是否由Pause或Shutdown主动取消，没有开始消费时为nil
+	wg       sync.WaitGroup // 转发和处理消息的goroutine
+}
+
+// consumerSeq 生成consumer tag的序号
+var consumerSeq atomic.Uint64
+
+// newConsumerTag 默认使用消费者名称，其次是队列名称
+// 两者都为空时（例如NoWait声明的服务端命名队列）生成唯一的tag，避免Cancel时使用空tag
+func newConsumerTag(name, queue string) string {
+	if name != "" {
+		return name
+	}
+	if queue != "" {
+		return queue
+	}
+	return fmt.Sprintf("rmq-consumer-%d", consumerSeq.Add(1))
+}
+
+// tag consumer tag，Cancel时使用
+func (run *consumerRun) tag() string {
+	return run.consumerTag
+}
+
+// running 是否正在消费
+func (run *consumerRun) running() bool {
+	return run.stopping != nil && !run.stopping.Load()
+}
+
+// startConsumer 开始消费，暂停的消费者不消费，Resume时再开始
+// 消息转发给ConsumeOptions.Concurrency个goroutine处理，消费被取消后处理完已经收到的消息再退出
+func (r *RabbitMQ) startConsumer(run *consumerRun) error {
+	r.consumeMux.Lock()
+	defer r.consumeMux.Unlock()
+
+	if r.paused[run.name] {
+		withFields(r.logger, "consumer", run.name, "queue", run.queue).Info("Consumer paused, skip consuming")
+		return nil
+	}
+	if run.running() {
+		return nil
+	}
+
+	options := run.config.ConsumeOptions
+	withFields(r.logger, "consumer", run.tag(), "queue", run.queue).Info("Start consuming")
+	msgs, err := run.ch.Consume(
+		run.queue,                  // queue
+		run.tag(),                  // consumer
+		options.AutoAck,            // auto-ack
+		options.Exclusive,          // exclusive
+		options.NoLocal,            // no-local
+		options.NoWait,             // no-wait
+		options.consumeArguments(), // args
+	)
+	if err != nil {
+		return fmt.Errorf("Consume error: %w", err)
+	}
+
+	ctx := r.sessionCtx
+	stopping := &atomic.Bool{}
+	run.stopping = stopping
+
+	out := make(chan amqp.Delivery)
+	r.sessionWg.Add(1)
+	run.wg.Add(1)
+	go func() {
+		defer func() {
+			defer r.sessionWg.Done()
+			defer run.wg.Done()
+			defer close(out)
+			withFields(r.logger, "consumer", run.tag(), "queue", run.queue).Info("Consuming done")
+		}()
+
+		withFields(r.logger, "consumer", run.tag(), "queue", run.queue).Debug("Receive messages")
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					if stopping.Load() {
+						return
+					}
+					// channel关闭或者消费者被broker取消(例如队列被删除)，通知重连
+					select {
+					case r.sessionErr <- fmt.Errorf("consumer of queue: %s closed", run.queue):
+					default:
+					}
+					return
+				}
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					requeue(msg, options.AutoAck)
+					requeuePending(msgs, options.AutoAck)
+					return
+				}
+			case <-ctx.Done():
+				requeuePending(msgs, options.AutoAck)
+				return
+			}
+		}
+	}()
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		r.sessionWg.Add(1)
+		run.wg.Add(1)
+		go func() {
+			defer r.sessionWg.Done()
+			defer run.wg.Done()
+			r.messageHandler(ctx, out, run.queue, run.config)
+		}()
+	}
+
+	return nil
+}
+
+// cancelConsumer 停止从broker接收消息，已经收到的消息继续处理
+func (r *RabbitMQ) cancelConsumer(run *consumerRun) {
+	r.consumeMux.Lock()
+	if !run.running() {
+		r.consumeMux.Unlock()
+		return
+	}
+	run.stopping.Store(true)
+	r.consumeMux.Unlock()
+
+	logger := withFields(r.logger, "consumer", run.tag(), "queue", run.queue)
+	logger.Info("Cancel consumer")
+	if err := run.ch.Cancel(run.tag(), false); err != nil {
+		logger.Warn("Cancel consumer error: %v", err)
+	}
+}
+
+func requeue(msg amqp.Delivery, autoAck bool) {
+	if !autoAck {
+		msg.Nack(false, true)
+	}
+}
+
+// requeuePending nack已经收到但还没有处理的消息并重新入队，不等待新的消息
+func requeuePending(msgs <-chan amqp.Delivery, autoAck bool) {
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			requeue(msg, autoAck)
+		default:
+			return
+		}
+	}
+}
+
+// hasConsumer 是否添加过名称为name的消费者
+func (r *RabbitMQ) hasConsumer(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, consumers := range r.config.Consumers {
+		for i := range consumers {
+			if consumers[i].name() == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Pause 暂停名称为name的消费者，broker不再投递新消息，已经收到的消息继续处理
+// 暂停状态在重连后保持，直到调用Resume
+func (r *RabbitMQ) Pause(name string) error {
+	r.consumeMux.Lock()
+	if !r.hasConsumer(name) {
+		r.consumeMux.Unlock()
+		return fmt.Errorf("consumer: %s not found", name)
+	}
+	r.paused[name] = true
+
+	var runs []*consumerRun
+	for _, run := range r.consumers {
+		if run.name == name {
+			runs = append(runs, run)
+		}
+	}
+	r.consumeMux.Unlock()
+
+	for _, run := range runs {
+		r.cancelConsumer(run)
+	}
+	return nil
+}
+
+// Resume 恢复Pause的消费者，未连接时在连接后开始消费
+func (r *RabbitMQ) Resume(name string) error {
+	r.consumeMux.Lock()
+	if !r.hasConsumer(name) {
+		r.consumeMux.Unlock()
+		return fmt.Errorf("consumer: %s not found", name)
+	}
+	delete(r.paused, name)
+
+	var runs []*consumerRun
+	for _, run := range r.consumers {
+		if run.name == name {
+			runs = append(runs, run)
+		}
+	}
+	r.consumeMux.Unlock()
+
+	for _, run := range runs {
+		// 等待暂停前收到的消息处理完成，再重新开始消费
+		run.wg.Wait()
+		if err := r.startConsumer(run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Paused 返回名称为name的消费者是否暂停
+func (r *RabbitMQ) Paused(name string) bool {
+	r.consumeMux.Lock()
+	defer r.consumeMux.Unlock()
+
+	return r.paused[name]
+}
+
+// Shutdown 优雅关闭，取消所有消费者，等待已经收到的消息处理完成后关闭连接
+// ctx超时后nack还没有处理的消息并重新入队，等待正在执行的handler返回后关闭连接，返回ctx.Err()
+func (r *RabbitMQ) Shutdown(ctx context.Context) error {
+	r.logger.Info("Shutting down RabbitMQ...")
+
+	r.consumeMux.Lock()
+	runs := append([]*consumerRun(nil), r.consumers...)
+	r.consumeMux.Unlock()
+
+	for _, run := range runs {
+		r.cancelConsumer(run)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, run := range runs {
+			run.wg.Wait()
+		}
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+		r.logger.Info("All in-flight messages handled")
+	case <-ctx.Done():
+		err = ctx.Err()
+		r.logger.Warn("Shutdown: %v, requeue unhandled messages", err)
+	}
+
+	r.Close()
+	return err
+}
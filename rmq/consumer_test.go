@@ -0,0 +1,56 @@
+package rmq
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRequeuePending(t *testing.T) {
+	msgs := make(chan amqp.Delivery, 3)
+	acks := []*fakeAcknowledger{{}, {}}
+	for _, ack := range acks {
+		msgs <- amqp.Delivery{Acknowledger: ack}
+	}
+
+	// 没有更多消息时立即返回，不等待channel关闭
+	requeuePending(msgs, false)
+
+	for i, ack := range acks {
+		if !ack.nacked || !ack.requeue {
+			t.Fatalf("message %d: nack: %v requeue: %v", i, ack.nacked, ack.requeue)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	r, _ := NewRabbitMQ("", 1, nil, nil, nil)
+	r.AddConsumerConfig("orders", ConsumerConfig{Name: "orders-worker", Handler: func(ctx context.Context, msg amqp.Delivery) error { return nil }})
+
+	if err := r.Pause("unknown"); err == nil {
+		t.Fatalf("pause unknown consumer should fail")
+	}
+
+	// 未连接时只记录暂停状态，连接后不消费
+	if err := r.Pause("orders-worker"); err != nil || !r.Paused("orders-worker") {
+		t.Fatalf("pause: %v", err)
+	}
+	if err := r.Resume("orders-worker"); err != nil || r.Paused("orders-worker") {
+		t.Fatalf("resume: %v", err)
+	}
+}
+
+func TestNewConsumerTag(t *testing.T) {
+	if tag := newConsumerTag("worker", "orders"); tag != "worker" {
+		t.Fatalf("tag: %s", tag)
+	}
+	if tag := newConsumerTag("", "orders"); tag != "orders" {
+		t.Fatalf("tag: %s", tag)
+	}
+	// 名称和队列都为空时生成不重复的tag
+	a, b := newConsumerTag("", ""), newConsumerTag("", "")
+	if a == "" || a == b {
+		t.Fatalf("tags: %q %q", a, b)
+	}
+}
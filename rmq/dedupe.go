@@ -0,0 +1,229 @@
+package rmq
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrDedupeInProgress 相同key的消息正在被其他handler处理，消息重新入队
+var ErrDedupeInProgress = errors.New("dedupe key in progress")
+
+// DedupeState Reserve的结果
+type DedupeState int
+
+const (
+	DedupeReserved   DedupeState = iota // 占用成功，可以处理
+	DedupeInProgress                    // 正在被其他handler处理
+	DedupeDone                          // 已经处理过
+)
+
+// DedupeStore 记录已经处理过的消息，用于Dedupe中间件
+type DedupeStore interface {
+	// Reserve 原子地占用key，key不存在或者已经过期时占用并返回DedupeReserved，占用在ttl后过期
+	Reserve(ctx context.Context, key string, ttl time.Duration) (DedupeState, error)
+	// Mark 记录key已经处理，ttl为0时不过期
+	Mark(ctx context.Context, key string, ttl time.Duration) error
+	// Release 释放Reserve占用的key，已经Mark的key不受影响
+	Release(ctx context.Context, key string) error
+}
+
+type dedupeOptions struct {
+	key    func(msg amqp.Delivery) string
+	ttl    time.Duration
+	lease  time.Duration
+	logger Logger
+}
+
+type DedupeOption func(*dedupeOptions)
+
+// WithDedupeKey 设置去重使用的key，默认为MessageId，返回空字符串的消息不去重
+func WithDedupeKey(key func(msg amqp.Delivery) string) DedupeOption {
+	return func(o *dedupeOptions) {
+		o.key = key
+	}
+}
+
+// WithDedupeTTL 设置处理记录的保存时间，默认24小时
+func WithDedupeTTL(ttl time.Duration) DedupeOption {
+	return func(o *dedupeOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithDedupeLease 设置处理期间占用key的时间，需要大于handler的处理时间，默认5分钟
+// 进程在处理期间退出时，占用过期后重新投递的消息可以再次处理
+func WithDedupeLease(lease time.Duration) DedupeOption {
+	return func(o *dedupeOptions) {
+		o.lease = lease
+	}
+}
+
+// WithDedupeLogger 设置记录失败时的日志，默认输出到标准输出
+func WithDedupeLogger(logger Logger) DedupeOption {
+	return func(o *dedupeOptions) {
+		o.logger = logger
+	}
+}
+
+// Dedupe 跳过已经处理过的消息，消息直接ack，不调用handler
+// 调用handler前原子地占用key，Concurrency大于1或者多个实例时相同key的消息也只处理一次
+// 相同key的消息正在处理时返回Requeue(ErrDedupeInProgress)，消息重新入队，等处理完成后跳过
+// handler返回nil后才记录消息已经处理，返回error时释放key，重新投递时会再次处理
+func Dedupe(store DedupeStore, opts ...DedupeOption) Middleware {
+	options := dedupeOptions{
+		key:   func(msg amqp.Delivery) string { return msg.MessageId },
+		ttl:   24 * time.Hour,
+		lease: 5 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.logger == nil {
+		options.logger = newStdLogger()
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg amqp.Delivery) error {
+			key := options.key(msg)
+			if key == "" {
+				return next(ctx, msg)
+			}
+
+			state, err := store.Reserve(ctx, key, options.lease)
+			if err != nil {
+				return fmt.Errorf("reserve dedupe key: %s error: %w", key, err)
+			}
+			switch state {
+			case DedupeDone:
+				return nil
+			case DedupeInProgress:
+				return Requeue(fmt.Errorf("dedupe key: %s error: %w", key, ErrDedupeInProgress))
+			}
+
+			if err = next(ctx, msg); err != nil {
+				if releaseErr := store.Release(ctx, key); releaseErr != nil {
+					withFields(options.logger, "dedupe_key", key).Error("Release dedupe key error: %v", releaseErr)
+				}
+				return err
+			}
+
+			// 消息已经处理成功，记录失败时不返回error，避免消息重新投递后再次处理
+			if err = store.Mark(ctx, key, options.ttl); err != nil {
+				withFields(options.logger, "dedupe_key", key).Error("Mark dedupe key error: %v", err)
+			}
+			return nil
+		}
+	}
+}
+
+type memoryDedupeEntry struct {
+	key     string
+	done    bool      // false表示Reserve占用，正在处理
+	expires time.Time // 为零值时不过期
+}
+
+// MemoryDedupeStore 内存中的DedupeStore，超过容量时淘汰最久没有使用的key
+// 只在单个进程内有效，多实例部署时使用SQLDedupeStore
+type MemoryDedupeStore struct {
+	mux      sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+// NewMemoryDedupeStore capacity为最多保存的key数量，小于等于0时不限制
+func NewMemoryDedupeStore(capacity int) *MemoryDedupeStore {
+	return &MemoryDedupeStore{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (s *MemoryDedupeStore) Reserve(ctx context.Context, key string, ttl time.Duration) (DedupeState, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if entry := s.get(key); entry != nil {
+		if entry.done {
+			return DedupeDone, nil
+		}
+		return DedupeInProgress, nil
+	}
+
+	s.set(key, false, ttl)
+	return DedupeReserved, nil
+}
+
+func (s *MemoryDedupeStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.set(key, true, ttl)
+	return nil
+}
+
+func (s *MemoryDedupeStore) Release(ctx context.Context, key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if elem, ok := s.entries[key]; ok && !elem.Value.(*memoryDedupeEntry).done {
+		s.lru.Remove(elem)
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// get 返回没有过期的key，过期的key被删除
+func (s *MemoryDedupeStore) get(key string) *memoryDedupeEntry {
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*memoryDedupeEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		s.lru.Remove(elem)
+		delete(s.entries, key)
+		return nil
+	}
+
+	s.lru.MoveToFront(elem)
+	return entry
+}
+
+func (s *MemoryDedupeStore) set(key string, done bool, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*memoryDedupeEntry)
+		entry.done = done
+		entry.expires = expires
+		s.lru.MoveToFront(elem)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&memoryDedupeEntry{key: key, done: done, expires: expires})
+	for s.capacity > 0 && s.lru.Len() > s.capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryDedupeEntry).key)
+	}
+}
+
+// Len 返回保存的key数量，包括已经过期但还没有被清理的key
+func (s *MemoryDedupeStore) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.lru.Len()
+}
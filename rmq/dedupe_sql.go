@@ -0,0 +1,104 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DedupeRecord SQLDedupeStore使用的表，可以放到db.DatabaseConfig.Tables中由db.Database迁移
+type DedupeRecord struct {
+	Key       string     `gorm:"column:message_key;primaryKey;size:255"`
+	Done      bool       // false表示Reserve占用，正在处理
+	ExpiresAt *time.Time `gorm:"index"` // 为空时不过期
+	CreatedAt time.Time
+}
+
+func (DedupeRecord) TableName() string {
+	return "rmq_dedupe"
+}
+
+// SQLDedupeStore 基于数据库的DedupeStore，多个实例共享处理记录
+// db通过db.Database.GetDatabase获取
+type SQLDedupeStore struct {
+	db *gorm.DB
+}
+
+func NewSQLDedupeStore(db *gorm.DB) *SQLDedupeStore {
+	return &SQLDedupeStore{db: db}
+}
+
+// Migrate 创建表，已经通过db.Database迁移时不需要调用
+func (s *SQLDedupeStore) Migrate() error {
+	if err := s.db.AutoMigrate(&DedupeRecord{}); err != nil {
+		return fmt.Errorf("migrate table: %s error: %w", DedupeRecord{}.TableName(), err)
+	}
+	return nil
+}
+
+// Reserve 删除过期的记录后插入，通过主键保证只有一个调用方插入成功
+func (s *SQLDedupeStore) Reserve(ctx context.Context, key string, ttl time.Duration) (DedupeState, error) {
+	db := s.db.WithContext(ctx)
+	now := time.Now()
+
+	err := db.Where("message_key = ? AND expires_at IS NOT NULL AND expires_at <= ?", key, now).
+		Delete(&DedupeRecord{}).Error
+	if err != nil {
+		return DedupeInProgress, err
+	}
+
+	record := DedupeRecord{Key: key}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		record.ExpiresAt = &expires
+	}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		return DedupeInProgress, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return DedupeReserved, nil
+	}
+
+	var existing DedupeRecord
+	if err = db.Where("message_key = ?", key).Limit(1).Find(&existing).Error; err != nil {
+		return DedupeInProgress, err
+	}
+	if existing.Done {
+		return DedupeDone, nil
+	}
+	return DedupeInProgress, nil
+}
+
+func (s *SQLDedupeStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	record := DedupeRecord{Key: key, Done: true}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		record.ExpiresAt = &expires
+	}
+
+	return s.db.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "message_key"}},
+			DoUpdates: clause.AssignmentColumns([]string{"done", "expires_at"}),
+		}).
+		Create(&record).Error
+}
+
+// Release 删除Reserve占用的记录
+func (s *SQLDedupeStore) Release(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).
+		Where("message_key = ? AND done = ?", key, false).
+		Delete(&DedupeRecord{}).Error
+}
+
+// Purge 删除已经过期的记录，返回删除的数量，需要定期调用
+func (s *SQLDedupeStore) Purge(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).
+		Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now()).
+		Delete(&DedupeRecord{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,137 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMemoryDedupeStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryDedupeStore(2)
+
+	s.Mark(ctx, "a", 0)
+	s.Mark(ctx, "b", time.Millisecond)
+	s.Mark(ctx, "c", 0)
+
+	if state, _ := s.Reserve(ctx, "c", time.Minute); state != DedupeDone {
+		t.Fatalf("c should be done: %v", state)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if state, _ := s.Reserve(ctx, "b", time.Minute); state != DedupeReserved {
+		t.Fatalf("b should be expired: %v", state)
+	}
+	if state, _ := s.Reserve(ctx, "a", time.Minute); state != DedupeReserved {
+		t.Fatalf("a should be evicted: %v", state)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("len: %d", s.Len())
+	}
+}
+
+func TestSQLDedupeStore(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s := NewSQLDedupeStore(db)
+	if err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Mark(ctx, "a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Mark(ctx, "b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// 重复记录时更新过期时间
+	if err = s.Mark(ctx, "b", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	if n, err := s.Purge(ctx); err != nil || n != 1 {
+		t.Fatalf("purge: %d %v", n, err)
+	}
+	if state, err := s.Reserve(ctx, "a", time.Minute); err != nil || state != DedupeDone {
+		t.Fatalf("a: %v %v", state, err)
+	}
+	if state, _ := s.Reserve(ctx, "b", time.Minute); state != DedupeReserved {
+		t.Fatalf("b should be expired: %v", state)
+	}
+
+	// 只有一个调用方可以占用key
+	if state, err := s.Reserve(ctx, "d", time.Minute); err != nil || state != DedupeReserved {
+		t.Fatalf("reserve: %v %v", state, err)
+	}
+	if state, _ := s.Reserve(ctx, "d", time.Minute); state != DedupeInProgress {
+		t.Fatalf("reserve again: %v", state)
+	}
+	s.Release(ctx, "d")
+	if state, _ := s.Reserve(ctx, "d", time.Millisecond); state != DedupeReserved {
+		t.Fatalf("reserve released: %v", state)
+	}
+	// 占用过期后可以再次占用
+	time.Sleep(2 * time.Millisecond)
+	if state, _ := s.Reserve(ctx, "d", time.Minute); state != DedupeReserved {
+		t.Fatalf("reserve expired: %v", state)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	calls := 0
+	fail := true
+	handler := Chain(func(ctx context.Context, msg amqp.Delivery) error {
+		calls++
+		if fail {
+			return errors.New("x")
+		}
+		return nil
+	}, Dedupe(NewMemoryDedupeStore(10)))
+
+	msg := amqp.Delivery{MessageId: "1"}
+	if err := handler(context.Background(), msg); err == nil {
+		t.Fatalf("want error")
+	}
+
+	fail = false
+	handler(context.Background(), msg)
+	handler(context.Background(), msg)
+	handler(context.Background(), amqp.Delivery{})
+	handler(context.Background(), amqp.Delivery{})
+
+	if calls != 4 {
+		t.Fatalf("calls: %d", calls)
+	}
+}
+
+func TestDedupeInProgress(t *testing.T) {
+	store := NewMemoryDedupeStore(10)
+	msg := amqp.Delivery{MessageId: "1"}
+
+	var inner error
+	handler := Chain(func(ctx context.Context, msg amqp.Delivery) error { return nil }, Dedupe(store))
+	// 第一条消息处理期间收到相同的消息
+	outer := Chain(func(ctx context.Context, msg amqp.Delivery) error {
+		inner = handler(ctx, msg)
+		return nil
+	}, Dedupe(store))
+	if err := outer(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if requeue, explicit := nackDecision(inner, NackDiscard); !errors.Is(inner, ErrDedupeInProgress) || !requeue || !explicit {
+		t.Fatalf("inner: %v", inner)
+	}
+	if state, _ := store.Reserve(context.Background(), "1", time.Minute); state != DedupeDone {
+		t.Fatalf("1 should be done: %v", state)
+	}
+}
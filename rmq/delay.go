@@ -0,0 +1,126 @@
+package rmq
+
+import (
+	"context"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunliang711/goutils/rmq/internal/protocol"
+)
+
+const (
+	// ExchangeDelayedMessage rabbitmq_delayed_message_exchange插件提供的exchange类型
+	ExchangeDelayedMessage = "x-delayed-message"
+
+	// DelayHeader 插件模式下指定延迟时间(毫秒)的消息头
+	DelayHeader = "x-delay"
+)
+
+// DelayedExchangeOptions 使用rabbitmq_delayed_message_exchange插件的exchange，kind为实际的路由类型(direct、topic等)
+// 用于AddProducer或者Topology，PublishDelayed向该exchange发送时使用插件，否则使用等待队列
+func DelayedExchangeOptions(kind string) ExchangeOptions {
+	return ExchangeOptions{
+		Type:      ExchangeDelayedMessage,
+		Durable:   true,
+		Arguments: amqp.Table{"x-delayed-type": kind},
+	}
+}
+
+// isDelayedExchange exchange是否声明为x-delayed-message类型
+func (r *RabbitMQ) isDelayedExchange(exchange string) bool {
+	if r.config.Producers[exchange].ExchangeOptions.Type == ExchangeDelayedMessage {
+		return true
+	}
+	for _, declaration := range r.config.Topology.Exchanges {
+		if declaration.Name == exchange && declaration.Type == ExchangeDelayedMessage {
+			return true
+		}
+	}
+	return false
+}
+
+// declareDelayQueue 声明exchange、routing key和延迟时间对应的等待队列，消息在队列中过期后通过死信发送到exchange
+// 等待队列设置了x-expires，长时间不使用时自动删除，所以每隔一段时间重新声明
+func (r *RabbitMQ) declareDelayQueue(exchange, routingKey string, delay time.Duration) (string, error) {
+	name := protocol.DelayQueueName(exchange, routingKey, delay)
+	expires := protocol.DelayQueueExpires(delay)
+
+	r.delayMux.Lock()
+	defer r.delayMux.Unlock()
+
+	if declared, ok := r.delayQueues[name]; ok && time.Since(declared) < expires/2 {
+		return name, nil
+	}
+
+	_, err := r.declareQueue(QueueOptions{
+		Name:      name,
+		Durable:   true,
+		Arguments: protocol.DelayQueueArguments(exchange, routingKey, delay),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if r.delayQueues == nil {
+		r.delayQueues = make(map[string]time.Time)
+	}
+	r.delayQueues[name] = time.Now()
+	return name, nil
+}
+
+// delayedMessage 生成延迟消息，exchange为x-delayed-message类型时使用插件，否则发送到等待队列
+func (r *RabbitMQ) delayedMessage(exchange, routingKey string, body []byte, delay time.Duration, opts ...PublishOption) (bufferedMessage, error) {
+	options := r.publishOptions(exchange, opts...)
+	msg := bufferedMessage{
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+	}
+
+	if r.isDelayedExchange(exchange) {
+		WithHeader(DelayHeader, delay.Milliseconds())(&options)
+	} else {
+		queue, err := r.declareDelayQueue(exchange, routingKey, delay)
+		if err != nil {
+			return msg, err
+		}
+		// 通过默认exchange直接发送到等待队列
+		msg.Exchange = ""
+		msg.RoutingKey = queue
+	}
+
+	msg.Publishing = options.Publishing(body)
+	return msg, nil
+}
+
+// PublishDelayed 发送延迟消息，delay之后消息才路由到exchange，delay小于等于0时和Publish相同
+// 默认使用等待队列，不需要安装插件，每个exchange、routing key和延迟时间(毫秒)声明一个等待队列，建议使用少量固定的延迟时间和routing key
+// exchange使用DelayedExchangeOptions声明时使用rabbitmq_delayed_message_exchange插件，延迟时间可以任意
+// 延迟消息不放入断线缓冲区，未连接时返回ErrNotConnected
+func (r *RabbitMQ) PublishDelayed(exchange, routingKey string, body []byte, delay time.Duration, opts ...PublishOption) error {
+	if delay <= 0 {
+		return r.Publish(exchange, routingKey, body, opts...)
+	}
+
+	// 等待队列模式下消息发送到默认exchange，指标按调用方的exchange记录
+	msg, err := r.delayedMessage(exchange, routingKey, body, delay, opts...)
+	if err == nil {
+		err = r.publish(msg.Exchange, msg.RoutingKey, msg.Publishing)
+	}
+	r.metrics.Published(exchange, publishResult(err))
+	return err
+}
+
+// PublishDelayedWithConfirm 和PublishDelayed相同，并等待broker确认
+// 等待队列模式下确认表示消息已经进入等待队列
+func (r *RabbitMQ) PublishDelayedWithConfirm(ctx context.Context, exchange, routingKey string, body []byte, delay time.Duration, opts ...PublishOption) error {
+	if delay <= 0 {
+		return r.PublishWithConfirm(ctx, exchange, routingKey, body, opts...)
+	}
+
+	msg, err := r.delayedMessage(exchange, routingKey, body, delay, opts...)
+	if err == nil {
+		err = r.publishWithConfirm(ctx, msg.Exchange, msg.RoutingKey, msg.Publishing)
+	}
+	r.metrics.Published(exchange, publishResult(err))
+	return err
+}
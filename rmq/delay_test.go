@@ -0,0 +1,59 @@
+package rmq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunliang711/goutils/rmq/internal/protocol"
+)
+
+func TestDelayQueueName(t *testing.T) {
+	if got := protocol.DelayQueueName("orders", "order.created", 1500*time.Millisecond); got != "orders.delay.1500.order.created" {
+		t.Fatalf("got %s", got)
+	}
+	if got := protocol.DelayQueueName("", "jobs", time.Second); got != "default.delay.1000.jobs" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestDelayedMessage(t *testing.T) {
+	r, _ := NewRabbitMQ("", 1, nil, nil, nil)
+	r.AddProducer("reminders", DelayedExchangeOptions(amqp.ExchangeTopic), WithPersistent(true))
+
+	// 插件模式不需要声明等待队列
+	msg, err := r.delayedMessage("reminders", "user.1", []byte("x"), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Exchange != "reminders" || msg.Publishing.Headers[DelayHeader] != int64(3000) || msg.Publishing.DeliveryMode != amqp.Persistent {
+		t.Fatalf("message: %+v", msg)
+	}
+
+	// 等待队列模式需要连接
+	if err = r.PublishDelayed("orders", "timeout", nil, time.Minute); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+type publishedMetrics struct {
+	nopMetrics
+	exchanges []string
+}
+
+func (m *publishedMetrics) Published(exchange string, result PublishResult) {
+	m.exchanges = append(m.exchanges, exchange)
+}
+
+func TestPublishDelayedMetrics(t *testing.T) {
+	metrics := &publishedMetrics{}
+	r, _ := NewRabbitMQ("", 1, nil, nil, nil, WithMetrics(metrics))
+	r.AddProducer("reminders", DelayedExchangeOptions(amqp.ExchangeTopic))
+
+	r.PublishDelayed("reminders", "user.1", nil, time.Second)
+	r.PublishDelayed("orders", "timeout", nil, time.Minute)
+	if len(metrics.exchanges) != 2 || metrics.exchanges[0] != "reminders" || metrics.exchanges[1] != "orders" {
+		t.Fatalf("published: %v", metrics.exchanges)
+	}
+}
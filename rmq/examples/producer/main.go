@@ -101,8 +101,8 @@ rq7qic/scGRARaFeSLWwFg7jn46aj3QVmfIn8U+HDqdXrBqJ9oe94a7U1rGSlLOP
 		Durable: true,
 	}
 
-	// 3. 添加生产者
-	rabbitMQ.AddProducer(exchangeName, exchangeOptions)
+	// 3. 添加生产者，该exchange的消息默认持久化
+	rabbitMQ.AddProducer(exchangeName, exchangeOptions, rmq.WithPersistent(true))
 
 	// 4. 连接
 	err = rabbitMQ.Connect()
@@ -114,7 +114,7 @@ rq7qic/scGRARaFeSLWwFg7jn46aj3QVmfIn8U+HDqdXrBqJ9oe94a7U1rGSlLOP
 	for {
 		// 5. 发送消息
 		log.Printf("Push message: %v\n", i)
-		err = rabbitMQ.Publish(exchangeName, "topic1", []byte(fmt.Sprintf("Hello, World: %v", i)))
+		err = rabbitMQ.Publish(exchangeName, "topic1", []byte(fmt.Sprintf("Hello, World: %v", i)), rmq.WithMessageId(fmt.Sprintf("msg-%v", i)))
 		if err != nil {
 			log.Printf("Failed to publish message: %s\n", err)
 			time.Sleep(time.Second * 1)
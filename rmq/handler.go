@@ -0,0 +1,145 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunliang711/goutils/rmq/internal/protocol"
+)
+
+// Requeue 包装handler返回的error，nack消息并重新入队，覆盖ConsumeOptions.NackPolicy
+func Requeue(err error) error {
+	return &protocol.NackError{Err: err, Requeue: true}
+}
+
+// Discard 包装handler返回的error，nack消息并且不重新入队，覆盖ConsumeOptions.NackPolicy
+func Discard(err error) error {
+	return &protocol.NackError{Err: err, Requeue: false}
+}
+
+// nackDecision 返回handler返回err时是否重新入队
+// explicit为true表示err由Requeue或Discard包装，覆盖了policy和重试
+func nackDecision(err error, policy NackPolicy) (requeue bool, explicit bool) {
+	return protocol.NackDecision(err, policy == NackRequeue)
+}
+
+// PanicError handler panic时转换成的error
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
+
+// legacyHandler 把MessageHandlerFunc转换为HandlerFunc
+func legacyHandler(handler MessageHandlerFunc) HandlerFunc {
+	return func(ctx context.Context, msg amqp.Delivery) error {
+		handler(msg)
+		return nil
+	}
+}
+
+// callHandler 调用handler，并把panic转换为*PanicError
+func callHandler(ctx context.Context, handler HandlerFunc, msg amqp.Delivery) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+
+	return handler(ctx, msg)
+}
+
+func (r *RabbitMQ) messageHandler(ctx context.Context, msgs <-chan amqp.Delivery, queue string, consumer ConsumerConfig) {
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				r.logger.Debug("Consumer channel closed")
+				return
+			}
+			r.metrics.Delivered(queue)
+			r.metrics.InFlight(queue, 1)
+			start := time.Now()
+			err := r.handleMessage(ctx, msg, &consumer)
+			r.metrics.Handled(queue, time.Since(start), err)
+			r.metrics.InFlight(queue, -1)
+		case <-ctx.Done():
+			r.logger.Debug("Session done, quit")
+			return
+		}
+	}
+}
+
+// handleMessage 调用handler并ack/nack消息，返回handler返回的error
+func (r *RabbitMQ) handleMessage(ctx context.Context, msg amqp.Delivery, consumer *ConsumerConfig) error {
+	err := callHandler(ContextWithDelivery(ctx, &msg), consumer.Handler, msg)
+
+	if err == nil {
+		// 自动ack或者由handler自己ack的消息不需要ack
+		if !consumer.ConsumeOptions.AutoAck && !consumer.manualAck {
+			if ackErr := msg.Ack(false); ackErr != nil {
+				r.messageLogger(msg, consumer).Error("Ack message error: %v", ackErr)
+			}
+		}
+		return err
+	}
+
+	logger := r.messageLogger(msg, consumer)
+
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		logger.Error("Handle message panic: %v\n%s", panicErr.Value, panicErr.Stack)
+	}
+
+	// 消息已经被自动ack或者由handler自己ack
+	if consumer.ConsumeOptions.AutoAck || consumer.manualAck {
+		if panicErr == nil {
+			logger.Error("Handle message error: %v", err)
+		}
+		return err
+	}
+
+	requeue, explicit := nackDecision(err, consumer.ConsumeOptions.NackPolicy)
+	if !explicit && consumer.QueueOptions.Retry != nil {
+		// 配置了重试时发送到重试队列，达到最大重试次数后进入死信队列
+		retried, retryErr := r.retry(msg, &consumer.QueueOptions)
+		switch {
+		case retryErr != nil:
+			// 没有确认进入重试队列，重新入队
+			logger.Error("Retry message error: %v", retryErr)
+			requeue = true
+		case retried:
+			withFields(logger, "attempt", strconv.Itoa(RetryCount(msg.Headers)+1)).Warn("Handle message error: %v, retry", err)
+			if ackErr := msg.Ack(false); ackErr != nil {
+				logger.Error("Ack message error: %v", ackErr)
+			}
+			return err
+		default:
+			requeue = false
+		}
+	}
+
+	logger.Warn("Handle message error: %v, nack with requeue: %v", err, requeue)
+	if nackErr := msg.Nack(false, requeue); nackErr != nil {
+		logger.Error("Nack message error: %v", nackErr)
+	}
+	return err
+}
+
+// messageLogger 返回附加了消息字段的Logger
+func (r *RabbitMQ) messageLogger(msg amqp.Delivery, consumer *ConsumerConfig) Logger {
+	return withFields(r.logger,
+		"exchange", msg.Exchange,
+		"queue", consumer.QueueOptions.Name,
+		"routing_key", msg.RoutingKey,
+		"delivery_tag", strconv.FormatUint(msg.DeliveryTag, 10),
+	)
+}
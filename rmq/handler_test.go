@@ -0,0 +1,62 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type fakeAcknowledger struct {
+	acked   bool
+	nacked  bool
+	requeue bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = true
+	a.requeue = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestHandleMessage(t *testing.T) {
+	r, _ := NewRabbitMQ("", 1, nil, nil, nil)
+
+	tests := []struct {
+		name        string
+		handler     HandlerFunc
+		policy      NackPolicy
+		wantAck     bool
+		wantNack    bool
+		wantRequeue bool
+	}{
+		{"ok", func(ctx context.Context, msg amqp.Delivery) error { return nil }, NackRequeue, true, false, false},
+		{"error requeue", func(ctx context.Context, msg amqp.Delivery) error { return errors.New("x") }, NackRequeue, false, true, true},
+		{"error discard", func(ctx context.Context, msg amqp.Delivery) error { return errors.New("x") }, NackDiscard, false, true, false},
+		{"override discard", func(ctx context.Context, msg amqp.Delivery) error { return Discard(errors.New("x")) }, NackRequeue, false, true, false},
+		{"override requeue", func(ctx context.Context, msg amqp.Delivery) error { return Requeue(errors.New("x")) }, NackDiscard, false, true, true},
+		{"panic", func(ctx context.Context, msg amqp.Delivery) error { panic("boom") }, NackDiscard, false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &fakeAcknowledger{}
+			consumer := &ConsumerConfig{Handler: tt.handler, ConsumeOptions: ConsumeOptions{NackPolicy: tt.policy}}
+			r.handleMessage(context.Background(), amqp.Delivery{Acknowledger: ack}, consumer)
+
+			if ack.acked != tt.wantAck || ack.nacked != tt.wantNack || ack.requeue != tt.wantRequeue {
+				t.Fatalf("got ack: %v nack: %v requeue: %v", ack.acked, ack.nacked, ack.requeue)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+// Package protocol rmq和rmqtest共用的约定，保证rmqtest的队列、路由和ack/nack处理和rmq相同
+package protocol
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderDeadLetterExchange   = "x-dead-letter-exchange"
+	HeaderDeadLetterRoutingKey = "x-dead-letter-routing-key"
+	HeaderMessageTTL           = "x-message-ttl"
+	HeaderExpires              = "x-expires"
+)
+
+// DelayQueueName 延迟消息的等待队列名称 <exchange>.delay.<毫秒数>.<routing key>，默认exchange为default
+// 消息通过默认exchange直接发送到等待队列，过期后按队列的死信参数发送到exchange，所以每个routing key一个等待队列
+func DelayQueueName(exchange, routingKey string, delay time.Duration) string {
+	if exchange == "" {
+		exchange = "default"
+	}
+	return fmt.Sprintf("%s.delay.%d.%s", exchange, delay.Milliseconds(), routingKey)
+}
+
+// DelayQueueExpires 等待队列没有使用时自动删除的时间，需要大于延迟时间，保证队列中的消息过期前队列不会被删除
+func DelayQueueExpires(delay time.Duration) time.Duration {
+	return 2*delay + time.Minute
+}
+
+// DelayQueueArguments 等待队列的参数，消息过期后发送到exchange，routing key不变
+func DelayQueueArguments(exchange, routingKey string, delay time.Duration) amqp.Table {
+	return amqp.Table{
+		HeaderMessageTTL:           delay.Milliseconds(),
+		HeaderDeadLetterExchange:   exchange,
+		HeaderDeadLetterRoutingKey: routingKey,
+		HeaderExpires:              DelayQueueExpires(delay).Milliseconds(),
+	}
+}
@@ -0,0 +1,27 @@
+package protocol
+
+import "errors"
+
+// NackError handler返回的error由rmq.Requeue或rmq.Discard包装，覆盖ConsumeOptions.NackPolicy
+type NackError struct {
+	Err     error
+	Requeue bool
+}
+
+func (e *NackError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NackError) Unwrap() error {
+	return e.Err
+}
+
+// NackDecision 返回handler返回err时是否重新入队，policyRequeue为NackPolicy是否为NackRequeue
+// explicit为true表示err由NackError包装，覆盖了policy和重试
+func NackDecision(err error, policyRequeue bool) (requeue bool, explicit bool) {
+	var nackErr *NackError
+	if errors.As(err, &nackErr) {
+		return nackErr.Requeue, true
+	}
+	return policyRequeue, false
+}
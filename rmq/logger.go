@@ -0,0 +1,88 @@
+package rmq
+
+import (
+	"fmt"
+	stdlog "log"
+	"os"
+	"strings"
+
+	"github.com/sunliang711/goutils/log"
+)
+
+// Logger rmq使用的分级日志接口，github.com/sunliang711/goutils/log.Logger实现了该接口
+type Logger interface {
+	Debug(format string, v ...any)
+	Info(format string, v ...any)
+	Warn(format string, v ...any)
+	Error(format string, v ...any)
+}
+
+var _ Logger = (*log.Logger)(nil)
+
+// stdLogger 默认的Logger，使用标准库log输出到标准输出
+type stdLogger struct {
+	logger *stdlog.Logger
+}
+
+func newStdLogger() Logger {
+	return &stdLogger{logger: stdlog.New(os.Stdout, "|RMQ| ", stdlog.LstdFlags)}
+}
+
+func (l *stdLogger) Debug(format string, v ...any) {
+	l.logger.Printf("[DEBUG] "+format, v...)
+}
+
+func (l *stdLogger) Info(format string, v ...any) {
+	l.logger.Printf("[INFO] "+format, v...)
+}
+
+func (l *stdLogger) Warn(format string, v ...any) {
+	l.logger.Printf("[WARN] "+format, v...)
+}
+
+func (l *stdLogger) Error(format string, v ...any) {
+	l.logger.Printf("[ERROR] "+format, v...)
+}
+
+// fieldsLogger 不支持结构化字段的Logger，把字段以key=value追加到日志末尾
+type fieldsLogger struct {
+	logger Logger
+	fields string
+}
+
+func (l *fieldsLogger) Debug(format string, v ...any) {
+	l.logger.Debug("%s%s", fmt.Sprintf(format, v...), l.fields)
+}
+
+func (l *fieldsLogger) Info(format string, v ...any) {
+	l.logger.Info("%s%s", fmt.Sprintf(format, v...), l.fields)
+}
+
+func (l *fieldsLogger) Warn(format string, v ...any) {
+	l.logger.Warn("%s%s", fmt.Sprintf(format, v...), l.fields)
+}
+
+func (l *fieldsLogger) Error(format string, v ...any) {
+	l.logger.Error("%s%s", fmt.Sprintf(format, v...), l.fields)
+}
+
+// withFields 返回附加了字段的Logger，keyValues为key、value交替的列表
+// log.Logger使用With添加结构化字段，其它Logger把字段追加到日志末尾
+func withFields(logger Logger, keyValues ...string) Logger {
+	if l, ok := logger.(*log.Logger); ok {
+		for i := 0; i+1 < len(keyValues); i += 2 {
+			l = l.With(keyValues[i], keyValues[i+1])
+		}
+		return l
+	}
+
+	var fields strings.Builder
+	if l, ok := logger.(*fieldsLogger); ok {
+		logger = l.logger
+		fields.WriteString(l.fields)
+	}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		fmt.Fprintf(&fields, " %s=%s", keyValues[i], keyValues[i+1])
+	}
+	return &fieldsLogger{logger: logger, fields: fields.String()}
+}
@@ -0,0 +1,44 @@
+package rmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/sunliang711/goutils/log"
+)
+
+type recordLogger struct {
+	lines []string
+}
+
+func (l *recordLogger) Debug(format string, v ...any) { l.record("debug", format, v...) }
+func (l *recordLogger) Info(format string, v ...any)  { l.record("info", format, v...) }
+func (l *recordLogger) Warn(format string, v ...any)  { l.record("warn", format, v...) }
+func (l *recordLogger) Error(format string, v ...any) { l.record("error", format, v...) }
+
+func (l *recordLogger) record(level, format string, v ...any) {
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, v...))
+}
+
+func TestWithFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(log.WithWriter(&buf), log.WithLevel("info"))
+	withFields(logger, "queue", "orders", "delivery_tag", "1").Info("Handle message")
+
+	var fields map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("unmarshal %s: %v", buf.String(), err)
+	}
+	if fields["queue"] != "orders" || fields["delivery_tag"] != "1" || fields["level"] != "info" {
+		t.Fatalf("fields: %v", fields)
+	}
+
+	// 不支持结构化字段的Logger，字段追加到日志末尾
+	record := &recordLogger{}
+	withFields(withFields(record, "queue", "orders"), "attempt", "2").Warn("retry %d%%", 50)
+	if len(record.lines) != 1 || record.lines[0] != "warn retry 50% queue=orders attempt=2" {
+		t.Fatalf("lines: %v", record.lines)
+	}
+}
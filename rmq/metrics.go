@@ -0,0 +1,55 @@
+package rmq
+
+import (
+	"errors"
+	"time"
+)
+
+// PublishResult 发送消息的结果，用于Metrics
+type PublishResult string
+
+const (
+	PublishOK       PublishResult = "ok"       // 发送成功，PublishWithConfirm为broker已确认
+	PublishNacked   PublishResult = "nacked"   // broker nack
+	PublishReturned PublishResult = "returned" // 消息无法路由被退回
+	PublishError    PublishResult = "error"    // 其它错误，例如未连接、超时
+)
+
+// Metrics 记录客户端的指标，需要并发安全
+// PrometheusMetrics实现了该接口，也可以对接其它监控系统
+type Metrics interface {
+	// Published 每次发送消息后调用
+	Published(exchange string, result PublishResult)
+	// Delivered 消费者收到消息时调用
+	Delivered(queue string)
+	// Handled handler返回后调用，err为handler返回的error
+	Handled(queue string, elapsed time.Duration, err error)
+	// InFlight 开始处理消息时delta为1，处理结束时为-1
+	InFlight(queue string, delta int)
+	// Reconnected 每次重连尝试后调用
+	Reconnected(success bool)
+}
+
+// nopMetrics 没有设置Metrics时使用，不记录任何指标
+type nopMetrics struct{}
+
+func (nopMetrics) Published(exchange string, result PublishResult)        {}
+func (nopMetrics) Delivered(queue string)                                 {}
+func (nopMetrics) Handled(queue string, elapsed time.Duration, err error) {}
+func (nopMetrics) InFlight(queue string, delta int)                       {}
+func (nopMetrics) Reconnected(success bool)                               {}
+
+// publishResult 根据发送返回的error判断结果
+func publishResult(err error) PublishResult {
+	var returned *ReturnedError
+	switch {
+	case err == nil:
+		return PublishOK
+	case errors.Is(err, ErrNacked):
+		return PublishNacked
+	case errors.As(err, &returned):
+		return PublishReturned
+	default:
+		return PublishError
+	}
+}
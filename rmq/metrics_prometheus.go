@@ -0,0 +1,210 @@
+package rmq
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets handler耗时直方图默认的桶(秒)
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // 每个桶的累计数量
+	sum    float64
+	count  uint64
+}
+
+// PrometheusMetrics 在内存中记录指标，以Prometheus文本格式输出
+// 可以通过Handler挂载到http/server的HttpServer上，例如 server.AddMetricsHandler("/metrics", metrics.Handler())
+//
+// 指标:
+//
+//	rmq_publish_total{exchange,result}            发送消息数量
+//	rmq_deliveries_total{queue}                   收到的消息数量
+//	rmq_handled_total{queue,result}               处理成功(success)和失败(failure)的消息数量
+//	rmq_handler_duration_seconds{queue}           handler耗时直方图
+//	rmq_in_flight{queue}                          正在处理的消息数量
+//	rmq_reconnect_attempts_total{result}          重连次数
+type PrometheusMetrics struct {
+	mux        sync.Mutex
+	buckets    []float64
+	publishes  map[[2]string]uint64 // exchange, result
+	deliveries map[string]uint64
+	handled    map[[2]string]uint64 // queue, result
+	latency    map[string]*histogram
+	inFlight   map[string]int64
+	reconnects map[string]uint64
+}
+
+var _ Metrics = (*PrometheusMetrics)(nil)
+
+// NewPrometheusMetrics buckets为handler耗时直方图的桶(秒)，为空时使用DefaultLatencyBuckets
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &PrometheusMetrics{
+		buckets:    buckets,
+		publishes:  make(map[[2]string]uint64),
+		deliveries: make(map[string]uint64),
+		handled:    make(map[[2]string]uint64),
+		latency:    make(map[string]*histogram),
+		inFlight:   make(map[string]int64),
+		reconnects: make(map[string]uint64),
+	}
+}
+
+func (m *PrometheusMetrics) Published(exchange string, result PublishResult) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.publishes[[2]string{exchange, string(result)}]++
+}
+
+func (m *PrometheusMetrics) Delivered(queue string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.deliveries[queue]++
+}
+
+func (m *PrometheusMetrics) Handled(queue string, elapsed time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.handled[[2]string{queue, result}]++
+
+	h, ok := m.latency[queue]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.latency[queue] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *PrometheusMetrics) InFlight(queue string, delta int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.inFlight[queue] += int64(delta)
+}
+
+func (m *PrometheusMetrics) Reconnected(success bool) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.reconnects[result]++
+}
+
+// WriteTo 以Prometheus文本格式输出所有指标
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var b strings.Builder
+
+	writeHeader(&b, "rmq_publish_total", "counter", "Number of published messages.")
+	for _, key := range sortedKeys2(m.publishes) {
+		fmt.Fprintf(&b, "rmq_publish_total{exchange=%s,result=%s} %d\n", quote(key[0]), quote(key[1]), m.publishes[key])
+	}
+
+	writeHeader(&b, "rmq_deliveries_total", "counter", "Number of received deliveries.")
+	for _, queue := range sortedKeys(m.deliveries) {
+		fmt.Fprintf(&b, "rmq_deliveries_total{queue=%s} %d\n", quote(queue), m.deliveries[queue])
+	}
+
+	writeHeader(&b, "rmq_handled_total", "counter", "Number of handled deliveries by result.")
+	for _, key := range sortedKeys2(m.handled) {
+		fmt.Fprintf(&b, "rmq_handled_total{queue=%s,result=%s} %d\n", quote(key[0]), quote(key[1]), m.handled[key])
+	}
+
+	writeHeader(&b, "rmq_handler_duration_seconds", "histogram", "Handler latency in seconds.")
+	for _, queue := range sortedKeys(m.latency) {
+		h := m.latency[queue]
+		for i, bound := range m.buckets {
+			fmt.Fprintf(&b, "rmq_handler_duration_seconds_bucket{queue=%s,le=\"%g\"} %d\n", quote(queue), bound, h.counts[i])
+		}
+		fmt.Fprintf(&b, "rmq_handler_duration_seconds_bucket{queue=%s,le=\"+Inf\"} %d\n", quote(queue), h.count)
+		fmt.Fprintf(&b, "rmq_handler_duration_seconds_sum{queue=%s} %g\n", quote(queue), h.sum)
+		fmt.Fprintf(&b, "rmq_handler_duration_seconds_count{queue=%s} %d\n", quote(queue), h.count)
+	}
+
+	writeHeader(&b, "rmq_in_flight", "gauge", "Number of deliveries being handled.")
+	for _, queue := range sortedKeys(m.inFlight) {
+		fmt.Fprintf(&b, "rmq_in_flight{queue=%s} %d\n", quote(queue), m.inFlight[queue])
+	}
+
+	writeHeader(&b, "rmq_reconnect_attempts_total", "counter", "Number of reconnect attempts by result.")
+	for _, result := range sortedKeys(m.reconnects) {
+		fmt.Fprintf(&b, "rmq_reconnect_attempts_total{result=%s} %d\n", quote(result), m.reconnects[result])
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Handler 返回输出指标的http.Handler
+func (m *PrometheusMetrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteTo(w)
+	})
+}
+
+func writeHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// quote 按Prometheus文本格式转义label的值
+func quote(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys2[V any](m map[[2]string]V) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
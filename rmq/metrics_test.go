@@ -0,0 +1,75 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestPublishResult(t *testing.T) {
+	tests := []struct {
+		err  error
+		want PublishResult
+	}{
+		{nil, PublishOK},
+		{ErrNacked, PublishNacked},
+		{&ReturnedError{ReplyCode: 312}, PublishReturned},
+		{ErrNotConnected, PublishError},
+	}
+
+	for _, tt := range tests {
+		if got := publishResult(tt.err); got != tt.want {
+			t.Fatalf("%v: got %s want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics(0.1, 1)
+	r, _ := NewRabbitMQ("", 1, nil, nil, nil, WithMetrics(m))
+
+	msgs := make(chan amqp.Delivery, 2)
+	msgs <- amqp.Delivery{Acknowledger: &fakeAcknowledger{}}
+	msgs <- amqp.Delivery{Acknowledger: &fakeAcknowledger{}}
+	close(msgs)
+
+	calls := 0
+	r.messageHandler(context.Background(), msgs, `orders"`, ConsumerConfig{Handler: func(ctx context.Context, msg amqp.Delivery) error {
+		calls++
+		if calls == 2 {
+			return errors.New("x")
+		}
+		return nil
+	}})
+
+	r.Publish("orders", "created", nil)
+	m.Reconnected(true)
+	m.Handled("slow", 500*time.Millisecond, nil)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		`rmq_publish_total{exchange="orders",result="error"} 1`,
+		`rmq_deliveries_total{queue="orders\""} 2`,
+		`rmq_handled_total{queue="orders\"",result="failure"} 1`,
+		`rmq_handled_total{queue="orders\"",result="success"} 1`,
+		`rmq_handler_duration_seconds_bucket{queue="slow",le="0.1"} 0`,
+		`rmq_handler_duration_seconds_bucket{queue="slow",le="1"} 1`,
+		`rmq_handler_duration_seconds_bucket{queue="slow",le="+Inf"} 1`,
+		`rmq_handler_duration_seconds_count{queue="slow"} 1`,
+		`rmq_in_flight{queue="orders\""} 0`,
+		`rmq_reconnect_attempts_total{result="success"} 1`,
+		`# TYPE rmq_handler_duration_seconds histogram`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %s in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TraceIDHeader Tracing中间件读取trace id的消息头
+const TraceIDHeader = "x-trace-id"
+
+// Middleware 包装HandlerFunc，和gin的中间件类似，可以在handler前后执行逻辑
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Chain 用middlewares包装handler，第一个middleware在最外层
+func Chain(handler HandlerFunc, middlewares ...Middleware) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Use 添加全局中间件，作用于所有消费者，在消费者自己的中间件之前执行，需要在Connect之前调用
+func (r *RabbitMQ) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+type deliveryKey struct{}
+type traceIDKey struct{}
+
+// ContextWithDelivery 把消息放入ctx，handler和中间件可以通过DeliveryFromContext读取
+func ContextWithDelivery(ctx context.Context, msg *amqp.Delivery) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, msg)
+}
+
+// DeliveryFromContext 返回正在处理的消息
+func DeliveryFromContext(ctx context.Context) (*amqp.Delivery, bool) {
+	msg, ok := ctx.Value(deliveryKey{}).(*amqp.Delivery)
+	return msg, ok
+}
+
+// HeaderFromContext 返回正在处理的消息的消息头
+func HeaderFromContext(ctx context.Context, key string) (any, bool) {
+	msg, ok := DeliveryFromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	v, ok := msg.Headers[key]
+	return v, ok
+}
+
+// ContextWithTraceID 把trace id放入ctx，配合WithTraceContext在发送消息时传递
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceIDFromContext 返回ctx中的trace id，没有时返回空字符串
+func TraceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	return traceID
+}
+
+// WithTraceContext 把ctx中的trace id放入消息头，用于在服务之间传递
+func WithTraceContext(ctx context.Context) PublishOption {
+	return func(o *PublishOptions) {
+		if traceID := TraceIDFromContext(ctx); traceID != "" {
+			WithHeader(TraceIDHeader, traceID)(o)
+		}
+	}
+}
+
+// Tracing 从消息头TraceIDHeader读取trace id放入ctx，消息头中没有时生成新的trace id
+func Tracing() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg amqp.Delivery) error {
+			traceID, _ := msg.Headers[TraceIDHeader].(string)
+			if traceID == "" {
+				traceID = newCorrelationId()
+			}
+			return next(ContextWithTraceID(ctx, traceID), msg)
+		}
+	}
+}
+
+// Recovery 把handler的panic转换为*PanicError，外层的中间件可以看到错误
+func Recovery() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg amqp.Delivery) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = &PanicError{Value: v, Stack: debug.Stack()}
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Timing handler执行结束后调用observe，传入耗时和handler返回的error
+func Timing(observe func(msg amqp.Delivery, elapsed time.Duration, err error)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg amqp.Delivery) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			observe(msg, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Logging 记录每条消息的exchange、routing key、耗时和结果，logger为nil时输出到标准输出
+// 处理成功为Info，返回error为Warn，panic为Error
+func Logging(logger Logger) Middleware {
+	if logger == nil {
+		logger = newStdLogger()
+	}
+
+	return Timing(func(msg amqp.Delivery, elapsed time.Duration, err error) {
+		l := withFields(logger,
+			"exchange", msg.Exchange,
+			"routing_key", msg.RoutingKey,
+			"delivery_tag", strconv.FormatUint(msg.DeliveryTag, 10),
+			"elapsed", elapsed.String(),
+		)
+
+		var panicErr *PanicError
+		switch {
+		case errors.As(err, &panicErr):
+			l.Error("Handle message panic: %v", panicErr.Value)
+		case err != nil:
+			l.Warn("Handle message error: %v", err)
+		default:
+			l.Info("Handle message")
+		}
+	})
+}
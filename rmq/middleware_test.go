@@ -0,0 +1,72 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	mw := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, msg amqp.Delivery) error {
+				calls = append(calls, name+">")
+				err := next(ctx, msg)
+				calls = append(calls, "<"+name)
+				return err
+			}
+		}
+	}
+
+	handler := Chain(func(ctx context.Context, msg amqp.Delivery) error {
+		calls = append(calls, "handler")
+		return nil
+	}, mw("a"), mw("b"))
+	handler(context.Background(), amqp.Delivery{})
+
+	if got := strings.Join(calls, " "); got != "a> b> handler <b <a" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var traceID string
+	handler := Chain(func(ctx context.Context, msg amqp.Delivery) error {
+		traceID = TraceIDFromContext(ctx)
+		return nil
+	}, Tracing())
+
+	handler(context.Background(), amqp.Delivery{Headers: amqp.Table{TraceIDHeader: "t1"}})
+	if traceID != "t1" {
+		t.Fatalf("got trace id %q want t1", traceID)
+	}
+
+	handler(context.Background(), amqp.Delivery{})
+	if traceID == "" || traceID == "t1" {
+		t.Fatalf("want generated trace id, got %q", traceID)
+	}
+
+	var o PublishOptions
+	WithTraceContext(ContextWithTraceID(context.Background(), "t2"))(&o)
+	if o.Headers[TraceIDHeader] != "t2" {
+		t.Fatalf("got headers %v", o.Headers)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	var seen error
+	handler := Chain(func(ctx context.Context, msg amqp.Delivery) error {
+		panic("boom")
+	}, Timing(func(msg amqp.Delivery, _ time.Duration, err error) { seen = err }), Recovery())
+
+	err := handler(context.Background(), amqp.Delivery{})
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) || !errors.As(seen, &panicErr) {
+		t.Fatalf("got err: %v seen: %v", err, seen)
+	}
+}
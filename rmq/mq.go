@@ -5,23 +5,57 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
-	"log"
-	"os"
 	"sync"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	declareMaxRetries    = 5
+	declareRetryInterval = time.Second * 2
+)
+
 type RabbitMQ struct {
 	config       Config
 	conn         *amqp.Connection
 	ch           *amqp.Channel
+	chMux        sync.RWMutex // 保护conn、ch和channel池，重连时原子替换
 	wg           sync.WaitGroup
 	reconnectMux sync.Mutex
 	consumeMux   sync.Mutex
+	consumers    []*consumerRun  // 当前会话的消费者，每个消费者单独的channel
+	paused       map[string]bool // Pause的消费者，重连后保持暂停
+
+	// 发送消息使用的channel池，confirmPool中的channel为confirm模式，用于PublishWithConfirm
+	pool        *channelPool
+	confirmPool *channelPool
+
+	// 每次连接为一个会话，断开时取消会话并等待所有消费者退出后再重连
+	sessionCtx    context.Context
+	sessionCancel context.CancelFunc
+	sessionWg     sync.WaitGroup
+	sessionErr    chan error
+
+	state    State
+	stateMux sync.Mutex
+
+	// 全局中间件
+	middlewares []Middleware
+
+	// 断线期间Publish的消息缓冲区
+	buffer *publishBuffer
+
+	// 已经声明的延迟消息等待队列和声明时间，每个连接重新声明
+	delayQueues map[string]time.Time
+	delayMux    sync.Mutex
 
-	logger *log.Logger
+	// rpc调用方使用的channel，每个连接一个
+	rpc    *rpcClient
+	rpcMux sync.Mutex
+
+	logger  Logger
+	metrics Metrics
 
 	ctx        context.Context
 	cancelFunc context.CancelFunc
@@ -30,62 +64,139 @@ type RabbitMQ struct {
 // NewRabbitMQ creates a new RabbitMQ instance
 // caCertBytes如果为空，则不使用服务端TLS
 // clientCert和clientKey如果为空，则不使用客户端TLS
-func NewRabbitMQ(url string, reconnect int, caCertBytes, clientCert, clientKey []byte) (*RabbitMQ, error) {
+// reconnect为断线重连的初始间隔(秒)，之后按指数退避增长
+func NewRabbitMQ(url string, reconnect int, caCertBytes, clientCert, clientKey []byte, opts ...Option) (*RabbitMQ, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	r := &RabbitMQ{
 		config: Config{
-			URL:          url,
-			ReconnectSec: reconnect,
-			CaCertBytes:  caCertBytes,
-			ClientCert:   clientCert,
-			ClientKey:    clientKey,
-			Consumers:    make(map[string][]ConsumerConfig),
-			Producers:    make(map[string]ProducerConfig),
+			URL:             url,
+			ReconnectSec:    reconnect,
+			ReconnectMaxSec: defaultReconnectMaxSec,
+			CaCertBytes:     caCertBytes,
+			ClientCert:      clientCert,
+			ClientKey:       clientKey,
+			Consumers:       make(map[string][]ConsumerConfig),
+			Producers:       make(map[string]ProducerConfig),
 		},
-		// closeCh:    make(chan struct{}),
-		logger:     log.New(os.Stdout, "|RMQ| ", log.LstdFlags),
+		paused:     make(map[string]bool),
 		ctx:        ctx,
 		cancelFunc: cancel,
 	}
 
+	for _, opt := range opts {
+		opt(&r.config)
+	}
+
+	r.logger = r.config.Logger
+	if r.logger == nil {
+		r.logger = newStdLogger()
+	}
+	r.metrics = r.config.Metrics
+	if r.metrics == nil {
+		r.metrics = nopMetrics{}
+	}
+
+	if r.config.PublishBufferSize > 0 {
+		buffer, err := newPublishBuffer(r.config.PublishBufferSize, r.config.PublishBufferPolicy, r.config.PublishSpoolFile)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.buffer = buffer
+	}
+
 	return r, nil
 }
 
+// AddConsumer 添加消费者，handler需要自己ack/nack消息
 func (r *RabbitMQ) AddConsumer(exchangeName string, topic string, handler MessageHandlerFunc, queueOptions QueueOptions, consumeOptions ConsumeOptions) error {
-	config := ConsumerConfig{
-		// ExchangeOptions: exchangeOptions,
-		Handler:        handler,
+	if handler == nil {
+		return fmt.Errorf("exchange %s handler is nil", exchangeName)
+	}
+
+	return r.addConsumer(exchangeName, ConsumerConfig{
+		Handler:        legacyHandler(handler),
 		Topic:          topic,
 		QueueOptions:   queueOptions,
 		ConsumeOptions: consumeOptions,
-	}
+		manualAck:      true,
+	})
+}
 
+// AddHandler 添加消费者，handler返回nil时ack消息，返回error时nack消息
+func (r *RabbitMQ) AddHandler(exchangeName string, topic string, handler HandlerFunc, queueOptions QueueOptions, consumeOptions ConsumeOptions) error {
 	if handler == nil {
 		return fmt.Errorf("exchange %s handler is nil", exchangeName)
 	}
 
+	return r.addConsumer(exchangeName, ConsumerConfig{
+		Handler:        handler,
+		Topic:          topic,
+		QueueOptions:   queueOptions,
+		ConsumeOptions: consumeOptions,
+	})
+}
+
+// AddConsumerConfig 使用完整的ConsumerConfig添加消费者，可以设置多个Topics和消费者声明的exchange
+// handler返回nil时ack消息，返回error时nack消息
+func (r *RabbitMQ) AddConsumerConfig(exchangeName string, config ConsumerConfig) error {
+	if config.Handler == nil {
+		return fmt.Errorf("exchange %s handler is nil", exchangeName)
+	}
+
+	return r.addConsumer(exchangeName, config)
+}
+
+func (r *RabbitMQ) addConsumer(exchangeName string, config ConsumerConfig) error {
 	r.config.Consumers[exchangeName] = append(r.config.Consumers[exchangeName], config)
 	return nil
 }
 
-func (r *RabbitMQ) AddProducer(exchangeName string, exchangeOptions ExchangeOptions) error {
+// AddProducer 添加生产者，defaults为向该exchange发送消息时的默认参数
+func (r *RabbitMQ) AddProducer(exchangeName string, exchangeOptions ExchangeOptions, defaults ...PublishOption) error {
 	exchange := ProducerConfig{
 		ExchangeOptions: exchangeOptions,
 	}
+	for _, opt := range defaults {
+		opt(&exchange.PublishOptions)
+	}
 
 	r.config.Producers[exchangeName] = exchange
 	return nil
 }
 
+// Connect 连接rabbitmq，声明exchange和队列并开始消费
+// 连接成功后断线会自动重连，重连后重新声明并重新开始消费
 func (r *RabbitMQ) Connect() error {
 	r.reconnectMux.Lock()
 	defer r.reconnectMux.Unlock()
 
-	var err error
+	if r.ctx.Err() != nil || r.State() == StateClosed {
+		return fmt.Errorf("rabbitmq closed")
+	}
+	if r.State() != StateDisconnected {
+		return fmt.Errorf("rabbitmq already connected")
+	}
+
+	err := r.connect()
+	if err != nil {
+		r.teardown()
+		return err
+	}
+	r.setState(StateConnected)
+	r.flushBuffer()
+
+	r.wg.Add(1)
+	go r.supervise()
+
+	return nil
+}
 
+// dial 建立连接
+func (r *RabbitMQ) dial() (*amqp.Connection, error) {
 	// cancelFunc 非空，使用服务端TLS
 	if len(r.config.CaCertBytes) > 0 {
-		r.logger.Printf("config server ca certificate")
+		r.logger.Debug("Config server ca certificate")
 		caCertPool := x509.NewCertPool()
 		caCertPool.AppendCertsFromPEM(r.config.CaCertBytes)
 
@@ -93,10 +204,10 @@ func (r *RabbitMQ) Connect() error {
 
 		// 如果clientCert和clientKey非空，则使用客户端TLS
 		if len(r.config.ClientCert) > 0 && len(r.config.ClientKey) > 0 {
-			r.logger.Printf("config client certificate")
+			r.logger.Debug("Config client certificate")
 			clientCert, err := tls.X509KeyPair(r.config.ClientCert, r.config.ClientKey)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			clientCertificates = append(clientCertificates, clientCert)
 		}
@@ -105,193 +216,251 @@ func (r *RabbitMQ) Connect() error {
 			RootCAs:      caCertPool,
 			Certificates: clientCertificates,
 		}
-		r.conn, err = amqp.DialTLS(r.config.URL, tlsConfig)
-		if err != nil {
-			return err
-		}
-	} else {
-		r.conn, err = amqp.Dial(r.config.URL)
-		if err != nil {
-			return err
-		}
+		return amqp.DialTLS(r.config.URL, tlsConfig)
+	}
+
+	return amqp.Dial(r.config.URL)
+}
+
+// connect 建立连接和channel，声明exchange和队列，并开始新的消费会话
+// 失败时调用者负责teardown
+func (r *RabbitMQ) connect() error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
 	}
 
-	r.ch, err = r.conn.Channel()
+	ch, err := conn.Channel()
 	if err != nil {
-		r.conn.Close() // 确保连接关闭
+		conn.Close() // 确保连接关闭
 		return err
 	}
 
+	r.chMux.Lock()
+	r.conn = conn
+	r.ch = ch
+	r.pool = newChannelPool(conn, r.config.PublishChannels, false, r.logger)
+	r.confirmPool = newChannelPool(conn, r.config.PublishChannels, true, r.logger)
+	r.chMux.Unlock()
+
 	// 声明produce exchange
 	for exchangeName, producer := range r.config.Producers {
-		r.logger.Printf("Declare exchange: %s", exchangeName)
-		err = r.ch.ExchangeDeclare(
-			exchangeName,                       // name
-			producer.ExchangeOptions.Type,      // type
-			producer.ExchangeOptions.Durable,   // durable
-			producer.ExchangeOptions.AutoDel,   // auto-deleted
-			producer.ExchangeOptions.Internal,  // internal
-			producer.ExchangeOptions.NoWait,    // no-wait
-			producer.ExchangeOptions.Arguments, // arguments
-		)
-		if err != nil {
+		if err = r.declareExchange(ch, exchangeName, producer.ExchangeOptions); err != nil {
 			return err
 		}
+	}
 
+	// 声明topology
+	if err = r.declareTopology(ch, &r.config.Topology); err != nil {
+		return err
 	}
 
-	r.handleReconnect()
+	r.sessionCtx, r.sessionCancel = context.WithCancel(r.ctx)
+	r.sessionErr = make(chan error, 1)
 
 	// 遍历consume exchange, 声明queue并绑定exchange
 	for exchangeName, consumers := range r.config.Consumers {
 		for _, consumer := range consumers {
-			ch, err := r.consume(r.ctx, exchangeName, &consumer)
+			// 全局中间件在消费者自己的中间件之前执行
+			middlewares := append(append([]Middleware{}, r.middlewares...), consumer.Middlewares...)
+			consumer.Handler = Chain(consumer.Handler, middlewares...)
+
+			run, err := r.consume(exchangeName, consumer)
 			if err != nil {
 				return err
 			}
-			go messageHandler(r.ctx, ch, consumer.Handler)
+
+			if err = r.startConsumer(run); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
-func (r *RabbitMQ) reconnect() {
-	for {
-		r.logger.Println("Attempting to reconnect...")
-		err := r.Connect()
-		if err == nil {
-			r.logger.Println("Reconnected to RabbitMQ")
-			return
-		}
-		r.logger.Printf("Failed to reconnect: %s. Retrying in %d seconds...", err, r.config.ReconnectSec)
-		time.Sleep(time.Duration(r.config.ReconnectSec) * time.Second)
+// channel 返回当前用于声明exchange和队列的channel，未连接时返回ErrNotConnected
+func (r *RabbitMQ) channel() (*amqp.Channel, error) {
+	r.chMux.RLock()
+	defer r.chMux.RUnlock()
+
+	if r.ch == nil {
+		return nil, ErrNotConnected
 	}
+	return r.ch, nil
 }
 
-func (r *RabbitMQ) handleReconnect() {
-	go func() {
-		err := <-r.conn.NotifyClose(make(chan *amqp.Error))
-		if err != nil {
-			r.logger.Printf("Connection closed: %s", err)
-			r.reconnect()
-		}
-	}()
+// Publish 发送消息，不等待broker确认
+// 需要确认消息被broker接收时使用PublishWithConfirm
+// 配置了WithPublishBuffer时，断线期间的消息放入缓冲区，重连后按顺序发送
+func (r *RabbitMQ) Publish(exchange, routingKey string, body []byte, opts ...PublishOption) error {
+	options := r.publishOptions(exchange, opts...)
+	msg := bufferedMessage{
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		Publishing: options.Publishing(body),
+	}
+
+	if r.buffer == nil {
+		return r.publishMessage(msg)
+	}
+
+	err := r.buffer.publish(msg, r.publishMessage)
+	// 连接正常时channel异常关闭(例如amqp.ErrClosed)导致放入缓冲区的消息，或者重连后还没有发送的消息，立即发送
+	if err == nil && r.State() == StateConnected && r.buffer.pending() > 0 {
+		r.flushBuffer()
+	}
+	return err
 }
 
-// TODO: mandatory immediate
-func (r *RabbitMQ) Publish(exchange, routingKey string, body []byte) error {
-	return r.ch.Publish(
-		exchange,   // exchange
-		routingKey, // routing key
-		false,      // mandatory
-		false,      // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        body,
-		},
-	)
+func (r *RabbitMQ) publishMessage(msg bufferedMessage) error {
+	err := r.publish(msg.Exchange, msg.RoutingKey, msg.Publishing)
+
+	// 断线时放入缓冲区的消息在重连后发送时再记录
+	if r.buffer == nil || !isDisconnected(err) {
+		r.metrics.Published(msg.Exchange, publishResult(err))
+	}
+	return err
+}
+
+// flushBuffer 连接成功后发送缓冲区中的消息
+func (r *RabbitMQ) flushBuffer() {
+	if r.buffer == nil {
+		return
+	}
+
+	sent, err := r.buffer.flush(r.publishMessage, func(msg bufferedMessage, err error) {
+		withFields(r.logger, "exchange", msg.Exchange, "routing_key", msg.RoutingKey).Error("Drop buffered message error: %v", err)
+	})
+	if sent > 0 {
+		r.logger.Info("Flushed %d buffered messages", sent)
+	}
+	if err != nil {
+		r.logger.Error("Flush buffered messages error: %v", err)
+	}
 }
 
-func (r *RabbitMQ) consume(ctx context.Context, exchangeName string, consumerConfig *ConsumerConfig) (<-chan amqp.Delivery, error) {
+// consume 声明队列和绑定，打开消费者的channel，由startConsumer开始消费
+func (r *RabbitMQ) consume(exchangeName string, consumerConfig ConsumerConfig) (*consumerRun, error) {
 	r.consumeMux.Lock()
 	defer r.consumeMux.Unlock()
 
-	var queue amqp.Queue
-	var err error
-	maxRetries := 5
-	retryInterval := time.Second * 2
-
-	for i := 0; i < maxRetries; i++ {
-		r.logger.Printf("Declare queue: %s", consumerConfig.QueueOptions.Name)
-		queue, err = r.ch.QueueDeclare(
-			consumerConfig.QueueOptions.Name,      // name
-			consumerConfig.QueueOptions.Durable,   // durable
-			consumerConfig.QueueOptions.AutoDel,   // delete when unused
-			consumerConfig.QueueOptions.Exclusive, // exclusive
-			consumerConfig.QueueOptions.NoWait,    // no-wait
-			consumerConfig.QueueOptions.Arguments, // arguments
-		)
-		if err == nil {
-			break
+	queueOptions := consumerConfig.QueueOptions
+	if queueOptions.Retry != nil {
+		var err error
+		queueOptions, err = r.declareRetryTopology(queueOptions)
+		if err != nil {
+			return nil, err
 		}
-		r.logger.Printf("Declare queue error: %v. Retrying in %v...", err, retryInterval)
-		time.Sleep(retryInterval)
 	}
 
+	queue, err := r.declareQueue(queueOptions)
 	if err != nil {
-		return nil, fmt.Errorf("declare queue: %s error: %w", consumerConfig.QueueOptions.Name, err)
+		return nil, err
+	}
+
+	ch, err := r.channel()
+	if err != nil {
+		return nil, err
+	}
+
+	// 消费者声明exchange，不依赖生产者先声明
+	if consumerConfig.ExchangeOptions != nil {
+		if err = r.declareExchange(ch, exchangeName, *consumerConfig.ExchangeOptions); err != nil {
+			return nil, err
+		}
 	}
 
 	// 绑定exchange和queue
-	for i := 0; i < maxRetries; i++ {
-		r.logger.Printf("Bind queue: %v to exchange: %v with topic: %v", queue.Name, exchangeName, consumerConfig.Topic)
-		err = r.ch.QueueBind(
-			queue.Name,           // queue name
-			consumerConfig.Topic, // routing key
-			exchangeName,         // exchange
-			false,
-			nil,
-		)
-		if err == nil {
-			break
+	for _, topic := range consumerConfig.RoutingKeys() {
+		for i := 0; i < declareMaxRetries; i++ {
+			withFields(r.logger, "queue", queue.Name, "exchange", exchangeName, "routing_key", topic).Info("Bind queue")
+			err = ch.QueueBind(
+				queue.Name,              // queue name
+				topic,                   // routing key
+				exchangeName,            // exchange
+				queueOptions.BindNoWait, // no-wait
+				queueOptions.BindArgs,   // arguments
+			)
+			if err == nil {
+				break
+			}
+			withFields(r.logger, "queue", queue.Name, "exchange", exchangeName, "routing_key", topic).Warn("Bind queue error: %v. Retrying in %v...", err, declareRetryInterval)
+			time.Sleep(declareRetryInterval)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("QueueBind error: %w", err)
 		}
-		r.logger.Printf("QueueBind error: %v. Retrying in %v...", err, retryInterval)
-		time.Sleep(retryInterval)
 	}
 
+	// 每个消费者使用单独的channel，避免互相阻塞，并且可以单独设置qos
+	consumerCh, err := r.conn.Channel()
 	if err != nil {
-		return nil, fmt.Errorf("QueueBind error: %w", err)
-	}
-
-	r.logger.Printf("Consume with queue: %s", queue.Name)
-	msgs, err := r.ch.Consume(
-		queue.Name,                              // queue
-		"",                                      // consumer
-		consumerConfig.ConsumeOptions.AutoAck,   // auto-ack
-		consumerConfig.ConsumeOptions.Exclusive, // exclusive
-		consumerConfig.ConsumeOptions.NoLocal,   // no-local
-		consumerConfig.ConsumeOptions.NoWait,    // no-wait
-		consumerConfig.ConsumeOptions.Arguments, // args
-	)
+		return nil, fmt.Errorf("open consumer channel error: %w", err)
+	}
+	run := &consumerRun{
+		name:        consumerConfig.name(),
+		queue:       queue.Name,
+		consumerTag: newConsumerTag(consumerConfig.name(), queue.Name),
+		ch:          consumerCh,
+		config:      consumerConfig,
+	}
+	r.consumers = append(r.consumers, run)
+
+	// stream队列的消费者必须设置prefetch
+	prefetch := consumerConfig.ConsumeOptions.Prefetch
+	if prefetch <= 0 && queueOptions.Type == QueueStream {
+		prefetch = defaultStreamPrefetch
+	}
+	if prefetch > 0 {
+		withFields(r.logger, "queue", queue.Name).Info("Set prefetch: %d", prefetch)
+		err = consumerCh.Qos(prefetch, 0, false)
+		if err != nil {
+			return nil, fmt.Errorf("Qos error: %w", err)
+		}
+	}
+
+	return run, nil
+}
+
+// declareQueue 声明队列，失败时重试
+func (r *RabbitMQ) declareQueue(queueOptions QueueOptions) (amqp.Queue, error) {
+	var queue amqp.Queue
+
+	ch, err := r.channel()
 	if err != nil {
-		return nil, fmt.Errorf("Consume error: %w", err)
+		return queue, err
 	}
 
-	out := make(chan amqp.Delivery)
-	r.wg.Add(1)
-	go func() {
-		defer func() {
-			defer r.wg.Done()
-			defer close(out)
-			r.logger.Printf("Consume from queue: %s done", queue.Name)
-		}()
-
-		r.logger.Printf("Receive messages from queue: %s", queue.Name)
-		for {
-			select {
-			case msg, ok := <-msgs:
-				if !ok {
-					return
-				}
-				out <- msg
-			case <-ctx.Done():
-				return
-			}
+	for i := 0; i < declareMaxRetries; i++ {
+		withFields(r.logger, "queue", queueOptions.Name).Info("Declare queue")
+		queue, err = ch.QueueDeclare(
+			queueOptions.Name,               // name
+			queueOptions.durable(),          // durable
+			queueOptions.AutoDel,            // delete when unused
+			queueOptions.Exclusive,          // exclusive
+			queueOptions.NoWait,             // no-wait
+			queueOptions.DeclareArguments(), // arguments
+		)
+		if err == nil {
+			return queue, nil
 		}
-	}()
-	return out, nil
+		withFields(r.logger, "queue", queueOptions.Name).Warn("Declare queue error: %v. Retrying in %v...", err, declareRetryInterval)
+		time.Sleep(declareRetryInterval)
+	}
+
+	return queue, fmt.Errorf("declare queue: %s error: %w", queueOptions.Name, err)
 }
 
 func (r *RabbitMQ) Close() {
-	r.logger.Println("Closing RabbitMQ connection...")
+	r.logger.Info("Closing RabbitMQ connection...")
 	r.cancelFunc()
-	r.wg.Wait()
-	r.logger.Println("All consumers stopped")
-	if err := r.ch.Close(); err != nil {
-		r.logger.Printf("Failed to close channel: %s", err)
-	}
-	if err := r.conn.Close(); err != nil {
-		r.logger.Printf("Failed to close connection: %s", err)
+	if r.buffer != nil {
+		r.buffer.close()
 	}
+	r.wg.Wait()
+	r.teardown()
+	r.logger.Info("All consumers stopped")
+	r.setState(StateClosed)
 }
@@ -0,0 +1,63 @@
+package rmq
+
+type Option func(*Config)
+
+// WithReconnectMaxSec 重连间隔按指数退避增长的上限，默认60秒
+func WithReconnectMaxSec(sec int) Option {
+	return func(c *Config) {
+		c.ReconnectMaxSec = sec
+	}
+}
+
+// WithReconnectMaxAttempts 断线后最大重连次数，超过后不再重连，为0时不限制
+func WithReconnectMaxAttempts(attempts int) Option {
+	return func(c *Config) {
+		c.ReconnectMaxAttempts = attempts
+	}
+}
+
+// WithStateHandler 连接状态变化时回调，回调在重连goroutine中同步执行，不要阻塞
+func WithStateHandler(handler func(State)) Option {
+	return func(c *Config) {
+		c.OnStateChange = handler
+	}
+}
+
+// WithLogger 设置日志，可以使用github.com/sunliang711/goutils/log.Logger，支持分级和结构化字段
+func WithLogger(logger Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// WithMetrics 设置指标，例如NewPrometheusMetrics()
+func WithMetrics(metrics Metrics) Option {
+	return func(c *Config) {
+		c.Metrics = metrics
+	}
+}
+
+// WithPublishChannels 设置发送消息的channel池大小，多个goroutine并发发送时每个goroutine取出一个channel
+// 大于1时同一个goroutine连续Publish的消息可能经过不同的channel，broker不保证这些消息的顺序
+func WithPublishChannels(channels int) Option {
+	return func(c *Config) {
+		c.PublishChannels = channels
+	}
+}
+
+// WithPublishBuffer 断线期间Publish的消息放入缓冲区，重连后按顺序发送
+// size为缓冲区最多缓存的消息数量，policy为缓冲区满时的处理方式
+func WithPublishBuffer(size int, policy OverflowPolicy) Option {
+	return func(c *Config) {
+		c.PublishBufferSize = size
+		c.PublishBufferPolicy = policy
+	}
+}
+
+// WithPublishSpool 缓冲区中的消息同时写入文件，进程重启后继续发送，需要同时使用WithPublishBuffer
+// 文件中的消息多于缓冲区大小时，OverflowDropOldest保留最新的消息，其他策略NewRabbitMQ返回error
+func WithPublishSpool(file string) Option {
+	return func(c *Config) {
+		c.PublishSpoolFile = file
+	}
+}
@@ -0,0 +1,383 @@
+package rmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OutboxMessage outbox表，可以放到db.DatabaseConfig.Tables中由db.Database迁移
+type OutboxMessage struct {
+	Id            uint64 `gorm:"primaryKey"`
+	AggregateKey  string `gorm:"size:255;index"` // 同一个key的消息按Id顺序发送，为空时不保证顺序
+	Exchange      string `gorm:"size:255"`
+	RoutingKey    string `gorm:"size:255"`
+	Body          []byte
+	Options       []byte     // json编码的PublishOptions
+	Attempts      int        // 发送失败的次数
+	LastError     string     `gorm:"size:1024"`
+	NextAttemptAt time.Time  // 发送失败后下次重试的时间
+	SentAt        *time.Time `gorm:"index"` // 发送成功的时间
+	FailedAt      *time.Time `gorm:"index"` // 超过最大重试次数的时间，不再发送
+	CreatedAt     time.Time
+}
+
+func (OutboxMessage) TableName() string {
+	return "rmq_outbox"
+}
+
+// PublishToOutbox 在事务tx中把消息写入outbox表，事务提交后由Outbox发送
+// 和业务数据在同一个事务中写入，进程在写库和发送之间退出时消息也不会丢失
+func PublishToOutbox(tx *gorm.DB, aggregateKey, exchange, routingKey string, body []byte, opts ...PublishOption) error {
+	var options PublishOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("encode publish options error: %w", err)
+	}
+
+	msg := OutboxMessage{
+		AggregateKey:  aggregateKey,
+		Exchange:      exchange,
+		RoutingKey:    routingKey,
+		Body:          body,
+		Options:       encoded,
+		NextAttemptAt: time.Now(),
+	}
+	if err = tx.Create(&msg).Error; err != nil {
+		return fmt.Errorf("insert outbox message error: %w", err)
+	}
+	return nil
+}
+
+// OutboxPublisher Outbox发送消息使用的接口，*RabbitMQ通过PublishWithConfirm确认broker已经收到消息
+type OutboxPublisher interface {
+	PublishWithConfirm(ctx context.Context, exchange, routingKey string, body []byte, opts ...PublishOption) error
+}
+
+type outboxOptions struct {
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	skipFailed  bool
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	timeout     time.Duration
+	logger      Logger
+}
+
+type OutboxOption func(*outboxOptions)
+
+// WithOutboxInterval 设置轮询outbox表的间隔，默认1秒
+func WithOutboxInterval(interval time.Duration) OutboxOption {
+	return func(o *outboxOptions) {
+		o.interval = interval
+	}
+}
+
+// WithOutboxBatchSize 设置每次读取的最大消息数量，默认100
+func WithOutboxBatchSize(batchSize int) OutboxOption {
+	return func(o *outboxOptions) {
+		o.batchSize = batchSize
+	}
+}
+
+// WithOutboxMaxAttempts 设置最大发送次数，超过后标记为失败，为0时一直重试，默认10
+func WithOutboxMaxAttempts(maxAttempts int) OutboxOption {
+	return func(o *outboxOptions) {
+		o.maxAttempts = maxAttempts
+	}
+}
+
+// WithOutboxSkipFailed 标记为失败的消息不再阻塞同一个AggregateKey后面的消息，后面的消息继续发送，不再保证顺序
+// 默认为false，失败的消息需要人工处理(清空failed_at重新发送，或者删除)后，后面的消息才会发送
+func WithOutboxSkipFailed(skipFailed bool) OutboxOption {
+	return func(o *outboxOptions) {
+		o.skipFailed = skipFailed
+	}
+}
+
+// WithOutboxBackoff 设置发送失败后的重试间隔，从min开始每次翻倍，最大为max，默认1秒到1分钟
+func WithOutboxBackoff(min, max time.Duration) OutboxOption {
+	return func(o *outboxOptions) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
+// WithOutboxPublishTimeout 设置每条消息等待broker确认的超时时间，默认5秒
+func WithOutboxPublishTimeout(timeout time.Duration) OutboxOption {
+	return func(o *outboxOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithOutboxLogger 设置日志，默认输出到标准输出
+func WithOutboxLogger(logger Logger) OutboxOption {
+	return func(o *outboxOptions) {
+		o.logger = logger
+	}
+}
+
+// Outbox 后台读取outbox表中没有发送的消息，发送成功后记录发送时间
+// 同一个AggregateKey的消息按写入顺序发送，前面的消息发送失败时后面的消息等待，超过最大次数后一直等待直到人工处理
+// 发送成功但记录失败时消息会再次发送，消费者可以用Dedupe中间件按MessageId去重，没有设置MessageId时使用outbox的Id
+// 多个实例同时运行Outbox时同一条消息可能发送多次
+type Outbox struct {
+	db        *gorm.DB
+	publisher OutboxPublisher
+	options   outboxOptions
+	logger    Logger
+
+	mux        sync.Mutex
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// NewOutbox db通过db.Database.GetDatabase获取，publisher通常为*RabbitMQ
+func NewOutbox(db *gorm.DB, publisher OutboxPublisher, opts ...OutboxOption) *Outbox {
+	options := outboxOptions{
+		interval:    time.Second,
+		batchSize:   100,
+		maxAttempts: 10,
+		minBackoff:  time.Second,
+		maxBackoff:  time.Minute,
+		timeout:     5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.logger == nil {
+		options.logger = newStdLogger()
+	}
+
+	return &Outbox{
+		db:        db,
+		publisher: publisher,
+		options:   options,
+		logger:    options.logger,
+	}
+}
+
+// Migrate 创建outbox表，已经通过db.Database迁移时不需要调用
+func (o *Outbox) Migrate() error {
+	if err := o.db.AutoMigrate(&OutboxMessage{}); err != nil {
+		return fmt.Errorf("migrate table: %s error: %w", OutboxMessage{}.TableName(), err)
+	}
+	return nil
+}
+
+// Start 启动后台发送，重复调用无效
+func (o *Outbox) Start() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if o.cancelFunc != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	o.cancelFunc = cancel
+
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+
+		ticker := time.NewTicker(o.options.interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := o.Relay(ctx); err != nil && ctx.Err() == nil {
+				o.logger.Error("Relay outbox messages error: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop 停止后台发送，等待正在进行的发送结束
+func (o *Outbox) Stop() {
+	o.mux.Lock()
+	cancel := o.cancelFunc
+	o.cancelFunc = nil
+	o.mux.Unlock()
+
+	if cancel != nil {
+		cancel()
+		o.wg.Wait()
+	}
+}
+
+// Relay 读取一批需要发送的消息并按Id顺序发送，返回发送成功的数量
+// 只读取已经到了重试时间的消息，同一个AggregateKey前面有还没到重试时间或者标记为失败的消息时不读取，保证同一个key按顺序发送
+// 使用WithOutboxSkipFailed时标记为失败的消息不阻塞后面的消息
+// Start在后台定期调用，也可以在测试中直接调用
+func (o *Outbox) Relay(ctx context.Context) (int, error) {
+	now := time.Now()
+	table := OutboxMessage{}.TableName()
+	// 同一个key前面还没到重试时间或者标记为失败的消息，前面已经到时间的消息按Id排序也在本批中
+	blocked := o.db.Table(table + " AS prev").
+		Select("1").
+		Where("prev.aggregate_key = " + table + ".aggregate_key AND prev.id < " + table + ".id").
+		Where("prev.sent_at IS NULL")
+	if o.options.skipFailed {
+		blocked = blocked.Where("prev.failed_at IS NULL AND prev.next_attempt_at > ?", now)
+	} else {
+		blocked = blocked.Where("prev.failed_at IS NOT NULL OR prev.next_attempt_at > ?", now)
+	}
+
+	var messages []OutboxMessage
+	err := o.db.WithContext(ctx).
+		Where("sent_at IS NULL AND failed_at IS NULL").
+		Where("next_attempt_at IS NULL OR next_attempt_at <= ?", now).
+		Where("aggregate_key = '' OR NOT EXISTS (?)", blocked).
+		Order("id").
+		Limit(o.options.batchSize).
+		Find(&messages).Error
+	if err != nil {
+		return 0, fmt.Errorf("query outbox messages error: %w", err)
+	}
+
+	sent := 0
+	failed := make(map[string]bool) // 本批中发送失败的AggregateKey，后面同一个key的消息等待
+	for i := range messages {
+		msg := &messages[i]
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+		if msg.AggregateKey != "" && failed[msg.AggregateKey] {
+			continue
+		}
+
+		if err = o.publish(ctx, msg); err != nil {
+			failed[msg.AggregateKey] = true
+			o.messageLogger(msg).Warn("Publish outbox message error: %v", err)
+			if err = o.markFailed(ctx, msg, err); err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		if err = o.db.WithContext(ctx).Model(msg).Update("sent_at", time.Now()).Error; err != nil {
+			return sent, fmt.Errorf("mark outbox message: %d sent error: %w", msg.Id, err)
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+func (o *Outbox) publish(ctx context.Context, msg *OutboxMessage) error {
+	var options PublishOptions
+	if err := json.Unmarshal(msg.Options, &options); err != nil {
+		return fmt.Errorf("decode publish options error: %w", err)
+	}
+	if options.MessageId == "" {
+		options.MessageId = strconv.FormatUint(msg.Id, 10)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.options.timeout)
+	defer cancel()
+
+	return o.publisher.PublishWithConfirm(ctx, msg.Exchange, msg.RoutingKey, msg.Body, withPublishOptions(options))
+}
+
+// markFailed 记录发送失败，超过最大次数后标记为失败
+func (o *Outbox) markFailed(ctx context.Context, msg *OutboxMessage, publishErr error) error {
+	attempts := msg.Attempts + 1
+	lastError := publishErr.Error()
+	if len(lastError) > 1024 {
+		lastError = lastError[:1024]
+	}
+
+	updates := map[string]any{
+		"attempts":        attempts,
+		"last_error":      lastError,
+		"next_attempt_at": time.Now().Add(o.backoff(attempts)),
+	}
+	if o.options.maxAttempts > 0 && attempts >= o.options.maxAttempts {
+		updates["failed_at"] = time.Now()
+		o.messageLogger(msg).Error("Outbox message failed after %d attempts", attempts)
+	}
+
+	if err := o.db.WithContext(ctx).Model(msg).Updates(updates).Error; err != nil {
+		return fmt.Errorf("update outbox message: %d error: %w", msg.Id, err)
+	}
+	return nil
+}
+
+// messageLogger 返回附加了消息字段的Logger
+func (o *Outbox) messageLogger(msg *OutboxMessage) Logger {
+	return withFields(o.logger,
+		"outbox_id", strconv.FormatUint(msg.Id, 10),
+		"aggregate_key", msg.AggregateKey,
+		"exchange", msg.Exchange,
+		"routing_key", msg.RoutingKey,
+		"attempt", strconv.Itoa(msg.Attempts+1),
+	)
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	backoff := o.options.minBackoff
+	for i := 1; i < attempts && backoff < o.options.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > o.options.maxBackoff {
+		backoff = o.options.maxBackoff
+	}
+	return backoff
+}
+
+// Purge 删除before之前发送成功的消息，返回删除的数量
+func (o *Outbox) Purge(ctx context.Context, before time.Time) (int64, error) {
+	result := o.db.WithContext(ctx).
+		Where("sent_at IS NOT NULL AND sent_at < ?", before).
+		Delete(&OutboxMessage{})
+	return result.RowsAffected, result.Error
+}
+
+// withPublishOptions 把保存的参数作为PublishOption，只覆盖设置过的字段，保留producer的默认参数
+func withPublishOptions(stored PublishOptions) PublishOption {
+	return func(o *PublishOptions) {
+		if stored.Headers != nil {
+			WithHeaders(stored.Headers)(o)
+		}
+		if stored.Persistent {
+			o.Persistent = true
+		}
+		if stored.ContentType != "" {
+			o.ContentType = stored.ContentType
+		}
+		if stored.CorrelationId != "" {
+			o.CorrelationId = stored.CorrelationId
+		}
+		if stored.MessageId != "" {
+			o.MessageId = stored.MessageId
+		}
+		if stored.Expiration > 0 {
+			o.Expiration = stored.Expiration
+		}
+		if stored.Priority > 0 {
+			o.Priority = stored.Priority
+		}
+		if !stored.Timestamp.IsZero() {
+			o.Timestamp = stored.Timestamp
+		}
+		if stored.ReplyTo != "" {
+			o.ReplyTo = stored.ReplyTo
+		}
+	}
+}
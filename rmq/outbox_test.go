@@ -0,0 +1,140 @@
+package rmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type fakePublisher struct {
+	fail    map[string]bool // 按routing key失败
+	options []PublishOptions
+	keys    []string
+}
+
+func (p *fakePublisher) PublishWithConfirm(ctx context.Context, exchange, routingKey string, body []byte, opts ...PublishOption) error {
+	if p.fail[routingKey] {
+		return errors.New("nacked")
+	}
+
+	var options PublishOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	p.keys = append(p.keys, routingKey)
+	p.options = append(p.options, options)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &fakePublisher{fail: map[string]bool{"a1": true}}
+	outbox := NewOutbox(db, publisher, WithOutboxBackoff(time.Millisecond, time.Millisecond), WithOutboxMaxAttempts(3))
+	if err = outbox.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		PublishToOutbox(tx, "a", "orders", "a1", nil, WithHeader("k", "v"))
+		PublishToOutbox(tx, "a", "orders", "a2", nil)
+		return PublishToOutbox(tx, "b", "orders", "b1", nil, WithMessageId("m1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 回滚的事务不写入outbox
+	db.Transaction(func(tx *gorm.DB) error {
+		PublishToOutbox(tx, "c", "orders", "c1", nil)
+		return errors.New("rollback")
+	})
+
+	ctx := context.Background()
+	if n, err := outbox.Relay(ctx); err != nil || n != 1 {
+		t.Fatalf("relay: %d %v", n, err)
+	}
+	if len(publisher.keys) != 1 || publisher.keys[0] != "b1" || publisher.options[0].MessageId != "m1" {
+		t.Fatalf("published: %v", publisher.keys)
+	}
+
+	// a1恢复后a1、a2按顺序发送
+	time.Sleep(2 * time.Millisecond)
+	publisher.fail = nil
+	if n, err := outbox.Relay(ctx); err != nil || n != 2 {
+		t.Fatalf("relay: %d %v", n, err)
+	}
+	if publisher.keys[1] != "a1" || publisher.keys[2] != "a2" || publisher.options[1].Headers["k"] != "v" || publisher.options[1].MessageId != "1" {
+		t.Fatalf("published: %v %v", publisher.keys, publisher.options[1])
+	}
+
+	var msg OutboxMessage
+	db.First(&msg, 1)
+	if msg.Attempts != 1 || msg.SentAt == nil {
+		t.Fatalf("message: %+v", msg)
+	}
+
+	// 超过最大次数后标记为失败，继续阻塞后面的消息
+	publisher.fail = map[string]bool{"d1": true}
+	db.Transaction(func(tx *gorm.DB) error {
+		PublishToOutbox(tx, "d", "orders", "d1", nil)
+		return PublishToOutbox(tx, "d", "orders", "d2", nil)
+	})
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * time.Millisecond)
+		outbox.Relay(ctx)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if n, err := outbox.Relay(ctx); err != nil || n != 0 {
+		t.Fatalf("relay: %d %v %v", n, err, publisher.keys)
+	}
+
+	// WithOutboxSkipFailed时失败的消息不阻塞后面的消息
+	skip := NewOutbox(db, publisher, WithOutboxSkipFailed(true))
+	if n, err := skip.Relay(ctx); err != nil || n != 1 || publisher.keys[3] != "d2" {
+		t.Fatalf("relay: %d %v %v", n, err, publisher.keys)
+	}
+}
+
+func TestOutboxBackoffAhead(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &fakePublisher{}
+	outbox := NewOutbox(db, publisher, WithOutboxBatchSize(1))
+	if err = outbox.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	PublishToOutbox(db, "x", "orders", "x1", nil)
+	PublishToOutbox(db, "x", "orders", "x2", nil)
+	PublishToOutbox(db, "y", "orders", "y1", nil)
+	// x1发送失败后等待重试
+	db.Model(&OutboxMessage{Id: 1}).Updates(map[string]any{"attempts": 1, "next_attempt_at": time.Now().Add(time.Hour)})
+
+	// 等待重试的消息不占用批次，后面同一个key的消息不能先发送
+	ctx := context.Background()
+	if n, err := outbox.Relay(ctx); err != nil || n != 1 || publisher.keys[0] != "y1" {
+		t.Fatalf("relay: %d %v %v", n, err, publisher.keys)
+	}
+	if n, err := outbox.Relay(ctx); err != nil || n != 0 {
+		t.Fatalf("relay: %d %v %v", n, err, publisher.keys)
+	}
+
+	db.Model(&OutboxMessage{Id: 1}).Update("next_attempt_at", time.Now())
+	for i := 0; i < 2; i++ {
+		outbox.Relay(ctx)
+	}
+	if len(publisher.keys) != 3 || publisher.keys[1] != "x1" || publisher.keys[2] != "x2" {
+		t.Fatalf("published: %v", publisher.keys)
+	}
+}
@@ -0,0 +1,210 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultPublishChannels = 1
+
+// channelPool 发送消息使用的channel池，每次发送时取出一个channel，发送完放回
+// 最多打开size个channel，都在使用时等待其他goroutine放回
+// channel在第一次取出时打开，取出时已经关闭(例如发送到不存在的exchange导致channel异常)则重新打开
+// 每个连接一个，断开时关闭
+type channelPool struct {
+	conn    *amqp.Connection
+	confirm bool
+	logger  Logger
+
+	slots chan *pooledChannel // 空闲的channel，nil表示可以打开一个新的channel
+	done  chan struct{}
+
+	mux    sync.Mutex
+	closed bool
+}
+
+// pooledChannel 同一时间只被一个goroutine使用，所以退回的消息和发送一一对应
+type pooledChannel struct {
+	ch      *amqp.Channel
+	returns chan amqp.Return // confirm模式下被broker退回的消息
+	closes  chan *amqp.Error // channel异常关闭的原因
+}
+
+func newChannelPool(conn *amqp.Connection, size int, confirm bool, logger Logger) *channelPool {
+	if size <= 0 {
+		size = defaultPublishChannels
+	}
+
+	p := &channelPool{
+		conn:    conn,
+		confirm: confirm,
+		logger:  logger,
+		slots:   make(chan *pooledChannel, size),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		p.slots <- nil
+	}
+	return p
+}
+
+// get 取出一个channel，使用完后必须调用put放回
+// 没有空闲的channel时等待，直到ctx取消或者连接断开
+func (p *channelPool) get(ctx context.Context) (*pooledChannel, error) {
+	select {
+	case <-p.done:
+		return nil, ErrNotConnected
+	default:
+	}
+
+	var pc *pooledChannel
+	select {
+	case pc = <-p.slots:
+	case <-p.done:
+		return nil, ErrNotConnected
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if pc != nil && !pc.ch.IsClosed() {
+		return pc, nil
+	}
+	if pc != nil {
+		p.logger.Debug("Publish channel closed, reopen")
+	}
+
+	pc, err := p.open()
+	if err != nil {
+		// 归还名额，下次取出时重新打开
+		p.slots <- nil
+		return nil, err
+	}
+	return pc, nil
+}
+
+// put 放回channel，连接已经断开时关闭channel
+func (p *channelPool) put(pc *pooledChannel) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed {
+		pc.close(p.logger)
+		pc = nil
+	}
+	p.slots <- pc
+}
+
+func (p *channelPool) open() (*pooledChannel, error) {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("open publish channel error: %w", err)
+	}
+
+	pc := &pooledChannel{
+		ch:     ch,
+		closes: ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+
+	if p.confirm {
+		if err = ch.Confirm(false); err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("put channel into confirm mode error: %w", err)
+		}
+		// basic.return 总是在对应的basic.ack之前到达，并且是同步写入该channel的，
+		// 所以有缓冲即可保证收到ack时return已经在channel中
+		pc.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	}
+
+	return pc, nil
+}
+
+// close 关闭空闲的channel，正在使用的channel在放回时关闭，等待中的get返回ErrNotConnected
+func (p *channelPool) close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+
+	drained := 0
+drain:
+	for {
+		select {
+		case pc := <-p.slots:
+			pc.close(p.logger)
+			drained++
+		default:
+			break drain
+		}
+	}
+	for i := 0; i < drained; i++ {
+		p.slots <- nil
+	}
+}
+
+func (pc *pooledChannel) close(logger Logger) {
+	if pc == nil {
+		return
+	}
+	if err := pc.ch.Close(); err != nil && err != amqp.ErrClosed {
+		logger.Warn("Failed to close publish channel: %s", err)
+	}
+}
+
+// closeError 连接断开时返回ErrNotConnected，channel异常关闭时返回关闭的原因
+func (p *channelPool) closeError(pc *pooledChannel) error {
+	if p.conn.IsClosed() {
+		return ErrNotConnected
+	}
+	select {
+	case err, ok := <-pc.closes:
+		if ok && err != nil {
+			return err
+		}
+	default:
+	}
+	return ErrNotConnected
+}
+
+// publishPool 返回当前连接的channel池，未连接时返回ErrNotConnected
+func (r *RabbitMQ) publishPool(confirm bool) (*channelPool, error) {
+	r.chMux.RLock()
+	defer r.chMux.RUnlock()
+
+	pool := r.pool
+	if confirm {
+		pool = r.confirmPool
+	}
+	if pool == nil {
+		return nil, ErrNotConnected
+	}
+	return pool, nil
+}
+
+// publish 从channel池取出一个channel发送消息，不等待broker确认
+func (r *RabbitMQ) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	pool, err := r.publishPool(false)
+	if err != nil {
+		return err
+	}
+
+	pc, err := pool.get(context.Background())
+	if err != nil {
+		return err
+	}
+	defer pool.put(pc)
+
+	return pc.ch.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		msg,
+	)
+}
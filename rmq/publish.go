@@ -0,0 +1,136 @@
+package rmq
+
+import (
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultContentType = ContentTypeText
+
+type PublishOptions struct {
+	Headers       amqp.Table    // headers 消息头
+	Persistent    bool          // persistent 如果设置为 true，消息持久化(DeliveryMode=2)，broker重启后仍然存在(需要队列也是durable)
+	ContentType   string        // content-type 默认为 text/plain
+	CorrelationId string        // correlation-id 关联id，常用于rpc
+	MessageId     string        // message-id 消息id，常用于消费端去重
+	Expiration    time.Duration // expiration 消息过期时间，为0时不过期
+	Priority      uint8         // priority 优先级 0-9
+	Timestamp     time.Time     // timestamp 消息时间戳
+	ReplyTo       string        // reply-to 回复队列
+}
+
+type PublishOption func(*PublishOptions)
+
+// WithHeaders 设置消息头，可以多次调用，后面的同名key覆盖前面的
+func WithHeaders(headers amqp.Table) PublishOption {
+	return func(o *PublishOptions) {
+		if o.Headers == nil {
+			o.Headers = make(amqp.Table, len(headers))
+		}
+		for k, v := range headers {
+			o.Headers[k] = v
+		}
+	}
+}
+
+func WithHeader(key string, value any) PublishOption {
+	return WithHeaders(amqp.Table{key: value})
+}
+
+func WithPersistent(persistent bool) PublishOption {
+	return func(o *PublishOptions) {
+		o.Persistent = persistent
+	}
+}
+
+func WithContentType(contentType string) PublishOption {
+	return func(o *PublishOptions) {
+		o.ContentType = contentType
+	}
+}
+
+func WithCorrelationId(correlationId string) PublishOption {
+	return func(o *PublishOptions) {
+		o.CorrelationId = correlationId
+	}
+}
+
+func WithMessageId(messageId string) PublishOption {
+	return func(o *PublishOptions) {
+		o.MessageId = messageId
+	}
+}
+
+func WithExpiration(expiration time.Duration) PublishOption {
+	return func(o *PublishOptions) {
+		o.Expiration = expiration
+	}
+}
+
+func WithPriority(priority uint8) PublishOption {
+	return func(o *PublishOptions) {
+		o.Priority = priority
+	}
+}
+
+func WithTimestamp(timestamp time.Time) PublishOption {
+	return func(o *PublishOptions) {
+		o.Timestamp = timestamp
+	}
+}
+
+func WithReplyTo(replyTo string) PublishOption {
+	return func(o *PublishOptions) {
+		o.ReplyTo = replyTo
+	}
+}
+
+// publishOptions 以exchange对应producer的默认参数为基础，应用opts
+func (r *RabbitMQ) publishOptions(exchange string, opts ...PublishOption) PublishOptions {
+	options := r.config.Producers[exchange].PublishOptions
+
+	// 复制headers，避免修改producer的默认值
+	if options.Headers != nil {
+		headers := make(amqp.Table, len(options.Headers))
+		for k, v := range options.Headers {
+			headers[k] = v
+		}
+		options.Headers = headers
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// Publishing 根据参数生成amqp.Publishing，ContentType为空时使用text/plain
+func (o *PublishOptions) Publishing(body []byte) amqp.Publishing {
+	msg := amqp.Publishing{
+		Headers:       o.Headers,
+		ContentType:   o.ContentType,
+		CorrelationId: o.CorrelationId,
+		MessageId:     o.MessageId,
+		Priority:      o.Priority,
+		Timestamp:     o.Timestamp,
+		ReplyTo:       o.ReplyTo,
+		Body:          body,
+	}
+
+	if msg.ContentType == "" {
+		msg.ContentType = defaultContentType
+	}
+
+	if o.Persistent {
+		msg.DeliveryMode = amqp.Persistent
+	}
+
+	if o.Expiration > 0 {
+		msg.Expiration = strconv.FormatInt(o.Expiration.Milliseconds(), 10)
+	}
+
+	return msg
+}
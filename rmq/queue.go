@@ -0,0 +1,128 @@
+package rmq
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunliang711/goutils/rmq/internal/protocol"
+)
+
+// QueueType 队列类型，对应x-queue-type参数
+type QueueType string
+
+const (
+	QueueClassic QueueType = "classic"
+	QueueQuorum  QueueType = "quorum" // 多副本队列，总是durable，不支持exclusive和auto-delete
+	QueueStream  QueueType = "stream" // 只追加的日志，总是durable，消费时不能自动ack并且需要prefetch
+)
+
+// QueueOverflow 队列达到最大长度时的处理方式，对应x-overflow参数
+type QueueOverflow string
+
+const (
+	QueueOverflowDropHead         QueueOverflow = "drop-head"          // 删除队头的消息，默认值
+	QueueOverflowRejectPublish    QueueOverflow = "reject-publish"     // 拒绝新消息，PublishWithConfirm返回ErrNacked
+	QueueOverflowRejectPublishDLX QueueOverflow = "reject-publish-dlx" // 拒绝新消息并发送到死信exchange，quorum队列不支持
+)
+
+const (
+	headerQueueType            = "x-queue-type"
+	headerMaxLength            = "x-max-length"
+	headerMaxLengthBytes       = "x-max-length-bytes"
+	headerOverflow             = "x-overflow"
+	headerSingleActiveConsumer = "x-single-active-consumer"
+	headerStreamOffset         = "x-stream-offset"
+
+	// defaultStreamPrefetch stream消费者没有设置Prefetch时使用的值
+	defaultStreamPrefetch = 100
+)
+
+// durable quorum和stream队列只能是durable
+func (o *QueueOptions) durable() bool {
+	return o.Durable || o.Type == QueueQuorum || o.Type == QueueStream
+}
+
+// DeclareArguments 返回声明队列时使用的参数，类型化的字段转换为对应的x-参数
+// Arguments中已经存在的参数优先，不会被覆盖
+func (o *QueueOptions) DeclareArguments() amqp.Table {
+	arguments := make(amqp.Table, len(o.Arguments)+8)
+	if o.Type != "" {
+		arguments[headerQueueType] = string(o.Type)
+	}
+	if o.MaxLength > 0 {
+		arguments[headerMaxLength] = int64(o.MaxLength)
+	}
+	if o.MaxLengthBytes > 0 {
+		arguments[headerMaxLengthBytes] = o.MaxLengthBytes
+	}
+	if o.Overflow != "" {
+		arguments[headerOverflow] = string(o.Overflow)
+	}
+	if o.MessageTTL > 0 {
+		arguments[protocol.HeaderMessageTTL] = o.MessageTTL.Milliseconds()
+	}
+	// 空字符串表示默认exchange，只设置了routing key时也需要设置exchange
+	if o.DeadLetterExchange != "" || o.DeadLetterRoutingKey != "" {
+		arguments[protocol.HeaderDeadLetterExchange] = o.DeadLetterExchange
+	}
+	if o.DeadLetterRoutingKey != "" {
+		arguments[protocol.HeaderDeadLetterRoutingKey] = o.DeadLetterRoutingKey
+	}
+	if o.SingleActiveConsumer {
+		arguments[headerSingleActiveConsumer] = true
+	}
+
+	for k, v := range o.Arguments {
+		arguments[k] = v
+	}
+	if len(arguments) == 0 {
+		return nil
+	}
+	return arguments
+}
+
+// StreamOffset stream消费者开始消费的位置，对应x-stream-offset参数
+type StreamOffset struct {
+	value any
+}
+
+var (
+	StreamOffsetFirst = StreamOffset{value: "first"} // 从stream中保留的第一条消息开始
+	StreamOffsetLast  = StreamOffset{value: "last"}  // 从最后写入的一批(chunk)消息开始
+	StreamOffsetNext  = StreamOffset{value: "next"}  // 只消费开始消费之后写入的消息，不设置时broker的默认值
+)
+
+// StreamOffsetAt 从指定的offset开始，offset可以通过DeliveryStreamOffset获取
+func StreamOffsetAt(offset int64) StreamOffset {
+	return StreamOffset{value: offset}
+}
+
+// StreamOffsetFrom 从t之后写入的消息开始，精度为秒，可能会收到t之前同一批(chunk)中的消息
+func StreamOffsetFrom(t time.Time) StreamOffset {
+	return StreamOffset{value: t}
+}
+
+// IsZero 是否没有设置
+func (o StreamOffset) IsZero() bool {
+	return o.value == nil
+}
+
+// DeliveryStreamOffset 返回stream队列中消息的offset，可以保存下来在重启后用StreamOffsetAt继续消费
+func DeliveryStreamOffset(msg amqp.Delivery) (int64, bool) {
+	offset, ok := msg.Headers[headerStreamOffset].(int64)
+	return offset, ok
+}
+
+// consumeArguments 返回消费时使用的参数，Arguments中已经存在的参数优先
+func (o *ConsumeOptions) consumeArguments() amqp.Table {
+	if o.StreamOffset.IsZero() {
+		return o.Arguments
+	}
+
+	arguments := make(amqp.Table, len(o.Arguments)+1)
+	arguments[headerStreamOffset] = o.StreamOffset.value
+	for k, v := range o.Arguments {
+		arguments[k] = v
+	}
+	return arguments
+}
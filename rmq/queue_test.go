@@ -0,0 +1,85 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunliang711/goutils/rmq/internal/protocol"
+)
+
+func TestQueueDeclareArguments(t *testing.T) {
+	options := QueueOptions{
+		Type:                 QueueQuorum,
+		MaxLength:            100,
+		MaxLengthBytes:       1 << 20,
+		Overflow:             QueueOverflowRejectPublish,
+		MessageTTL:           time.Minute,
+		DeadLetterRoutingKey: "orders.dlq",
+		SingleActiveConsumer: true,
+		Arguments:            amqp.Table{headerMaxLength: int64(10)},
+	}
+
+	arguments := options.DeclareArguments()
+	expected := amqp.Table{
+		headerQueueType:                     "quorum",
+		headerMaxLength:                     int64(10),
+		headerMaxLengthBytes:                int64(1 << 20),
+		headerOverflow:                      "reject-publish",
+		protocol.HeaderMessageTTL:           int64(60000),
+		protocol.HeaderDeadLetterExchange:   "",
+		protocol.HeaderDeadLetterRoutingKey: "orders.dlq",
+		headerSingleActiveConsumer:          true,
+	}
+	if len(arguments) != len(expected) {
+		t.Fatalf("arguments: %v", arguments)
+	}
+	for k, v := range expected {
+		if arguments[k] != v {
+			t.Fatalf("argument %s: %v, expected: %v", k, arguments[k], v)
+		}
+	}
+	if err := arguments.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !options.durable() {
+		t.Fatal("quorum queue should be durable")
+	}
+
+	if arguments := (&QueueOptions{}).DeclareArguments(); arguments != nil {
+		t.Fatalf("empty options arguments: %v", arguments)
+	}
+}
+
+func TestConsumeStreamOffset(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		offset   StreamOffset
+		expected any
+	}{
+		{StreamOffsetFirst, "first"},
+		{StreamOffsetLast, "last"},
+		{StreamOffsetNext, "next"},
+		{StreamOffsetAt(42), int64(42)},
+		{StreamOffsetFrom(now), now},
+	}
+	for _, c := range cases {
+		options := ConsumeOptions{StreamOffset: c.offset}
+		arguments := options.consumeArguments()
+		if arguments[headerStreamOffset] != c.expected {
+			t.Fatalf("stream offset: %v, expected: %v", arguments[headerStreamOffset], c.expected)
+		}
+		if err := arguments.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if arguments := (&ConsumeOptions{}).consumeArguments(); arguments != nil {
+		t.Fatalf("empty options arguments: %v", arguments)
+	}
+
+	offset, ok := DeliveryStreamOffset(amqp.Delivery{Headers: amqp.Table{headerStreamOffset: int64(7)}})
+	if !ok || offset != 7 {
+		t.Fatalf("delivery offset: %d %v", offset, ok)
+	}
+}
@@ -0,0 +1,190 @@
+package rmq
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultReconnectMaxSec = 60
+
+type State int
+
+const (
+	StateDisconnected State = iota // 未连接或者连接断开
+	StateConnected                 // 已连接
+	StateReconnecting              // 正在重连
+	StateClosed                    // 已调用Close，或者超过最大重连次数
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// State 返回当前连接状态
+func (r *RabbitMQ) State() State {
+	r.stateMux.Lock()
+	defer r.stateMux.Unlock()
+
+	return r.state
+}
+
+func (r *RabbitMQ) setState(state State) {
+	r.stateMux.Lock()
+	changed := r.state != state
+	r.state = state
+	r.stateMux.Unlock()
+
+	if changed {
+		withFields(r.logger, "state", state.String()).Info("Connection state changed")
+		if r.config.OnStateChange != nil {
+			r.config.OnStateChange(state)
+		}
+	}
+}
+
+// supervise 监听连接和channel的关闭，断开后清理本次会话并重连
+func (r *RabbitMQ) supervise() {
+	defer r.wg.Done()
+
+	for {
+		r.chMux.RLock()
+		connClose := r.conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClose := r.ch.NotifyClose(make(chan *amqp.Error, 1))
+		sessionErr := r.sessionErr
+		r.chMux.RUnlock()
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case err := <-connClose:
+			r.logger.Warn("Connection closed: %v", err)
+		case err := <-chClose:
+			r.logger.Warn("Channel closed: %v", err)
+		case err := <-sessionErr:
+			r.logger.Warn("Consumer stopped: %v", err)
+		}
+
+		// Close 主动关闭
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		r.teardown()
+		r.setState(StateDisconnected)
+
+		if !r.reconnect() {
+			if r.ctx.Err() == nil {
+				r.setState(StateClosed)
+			}
+			return
+		}
+	}
+}
+
+// reconnect 按指数退避重连，返回false表示已经关闭或超过最大重连次数
+func (r *RabbitMQ) reconnect() bool {
+	interval := time.Duration(r.config.ReconnectSec) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	maxInterval := time.Duration(r.config.ReconnectMaxSec) * time.Second
+	if maxInterval <= 0 {
+		maxInterval = defaultReconnectMaxSec * time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		if r.config.ReconnectMaxAttempts > 0 && attempt > r.config.ReconnectMaxAttempts {
+			r.logger.Error("Give up reconnecting after %d attempts", r.config.ReconnectMaxAttempts)
+			return false
+		}
+
+		r.setState(StateReconnecting)
+		withFields(r.logger, "attempt", strconv.Itoa(attempt)).Info("Attempting to reconnect...")
+
+		r.reconnectMux.Lock()
+		err := r.connect()
+		r.reconnectMux.Unlock()
+		r.metrics.Reconnected(err == nil)
+		if err == nil {
+			r.logger.Info("Reconnected to RabbitMQ")
+			r.setState(StateConnected)
+			r.flushBuffer()
+			return true
+		}
+		r.teardown()
+
+		// 随机抖动，避免多个客户端同时重连
+		sleep := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+		withFields(r.logger, "attempt", strconv.Itoa(attempt)).Warn("Failed to reconnect: %s. Retrying in %v...", err, sleep)
+		select {
+		case <-time.After(sleep):
+		case <-r.ctx.Done():
+			return false
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// teardown 停止本次会话的所有消费者，并关闭所有channel和连接
+func (r *RabbitMQ) teardown() {
+	if r.sessionCancel != nil {
+		r.sessionCancel()
+	}
+	r.sessionWg.Wait()
+
+	r.closeRPC()
+
+	r.delayMux.Lock()
+	r.delayQueues = nil
+	r.delayMux.Unlock()
+
+	r.consumeMux.Lock()
+	for _, run := range r.consumers {
+		if err := run.ch.Close(); err != nil && err != amqp.ErrClosed {
+			withFields(r.logger, "queue", run.queue).Warn("Failed to close consumer channel: %s", err)
+		}
+	}
+	r.consumers = nil
+	r.consumeMux.Unlock()
+
+	r.chMux.Lock()
+	defer r.chMux.Unlock()
+	// 发送消息的channel异常关闭时由channel池重新打开，不需要重连
+	for _, pool := range []*channelPool{r.pool, r.confirmPool} {
+		if pool != nil {
+			pool.close()
+		}
+	}
+	r.pool = nil
+	r.confirmPool = nil
+	if r.ch != nil {
+		if err := r.ch.Close(); err != nil && err != amqp.ErrClosed {
+			r.logger.Warn("Failed to close channel: %s", err)
+		}
+		r.ch = nil
+	}
+	if r.conn != nil {
+		if err := r.conn.Close(); err != nil && err != amqp.ErrClosed {
+			r.logger.Warn("Failed to close connection: %s", err)
+		}
+		r.conn = nil
+	}
+}
@@ -0,0 +1,175 @@
+package rmq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunliang711/goutils/rmq/internal/protocol"
+)
+
+const (
+	// RetryCountHeader 记录消息已经重试的次数
+	RetryCountHeader = "x-retry-count"
+
+	// retryPublishTimeout 发送到重试队列时等待broker确认的最长时间
+	retryPublishTimeout = 5 * time.Second
+)
+
+// RetryOptions handler返回error时延迟重试，超过最大重试次数后进入死信队列
+// 每个延迟时间对应一个重试队列 <queue>.retry.<毫秒数>，消息在重试队列中过期后回到原队列
+// 原队列的死信参数指向死信队列，所以nack且不重新入队的消息也会进入死信队列
+type RetryOptions struct {
+	Delays          []time.Duration `mapstructure:"delays"`            // 第n次重试前的等待时间为Delays[n-1]，超出长度时使用最后一个，为空时使用1秒
+	MaxAttempts     int             `mapstructure:"max_attempts"`      // 最大重试次数，超过后进入死信队列
+	DeadLetterQueue string          `mapstructure:"dead_letter_queue"` // 死信队列名称，为空时为 <queue>.dlq
+}
+
+func (o *RetryOptions) delay(attempt int) time.Duration {
+	if len(o.Delays) == 0 {
+		return time.Second
+	}
+	if attempt > len(o.Delays) {
+		attempt = len(o.Delays)
+	}
+	return o.Delays[attempt-1]
+}
+
+// DeadLetterQueueName 返回queue对应的死信队列名称
+func (o *RetryOptions) DeadLetterQueueName(queue string) string {
+	if o.DeadLetterQueue != "" {
+		return o.DeadLetterQueue
+	}
+	return queue + ".dlq"
+}
+
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queue, delay.Milliseconds())
+}
+
+// declareRetryTopology 声明死信队列和重试队列，返回添加了死信参数的队列配置
+func (r *RabbitMQ) declareRetryTopology(queueOptions QueueOptions) (QueueOptions, error) {
+	retry := queueOptions.Retry
+	if queueOptions.Name == "" {
+		return queueOptions, fmt.Errorf("retry needs a named queue")
+	}
+
+	dlq := retry.DeadLetterQueueName(queueOptions.Name)
+	_, err := r.declareQueue(QueueOptions{
+		Name:    dlq,
+		Durable: queueOptions.Durable,
+	})
+	if err != nil {
+		return queueOptions, err
+	}
+
+	delays := retry.Delays
+	if len(delays) == 0 {
+		delays = []time.Duration{time.Second}
+	}
+	declared := make(map[string]bool)
+	for _, delay := range delays {
+		name := retryQueueName(queueOptions.Name, delay)
+		if declared[name] {
+			continue
+		}
+		declared[name] = true
+
+		// 过期后通过默认exchange回到原队列
+		_, err = r.declareQueue(QueueOptions{
+			Name:    name,
+			Durable: queueOptions.Durable,
+			Arguments: amqp.Table{
+				protocol.HeaderMessageTTL:           delay.Milliseconds(),
+				protocol.HeaderDeadLetterExchange:   "",
+				protocol.HeaderDeadLetterRoutingKey: queueOptions.Name,
+			},
+		})
+		if err != nil {
+			return queueOptions, err
+		}
+	}
+
+	arguments := make(amqp.Table, len(queueOptions.Arguments)+2)
+	for k, v := range queueOptions.Arguments {
+		arguments[k] = v
+	}
+	arguments[protocol.HeaderDeadLetterExchange] = ""
+	arguments[protocol.HeaderDeadLetterRoutingKey] = dlq
+	queueOptions.Arguments = arguments
+
+	return queueOptions, nil
+}
+
+// RetryCount 从消息头中读取已经重试的次数
+func RetryCount(headers amqp.Table) int {
+	switch v := headers[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// retry 把消息发送到对应的重试队列，并等待broker确认，确认之后才能ack原消息，否则消息可能丢失
+// 返回false表示已经达到最大重试次数
+func (r *RabbitMQ) retry(msg amqp.Delivery, queueOptions *QueueOptions) (bool, error) {
+	retry := queueOptions.Retry
+	attempt := RetryCount(msg.Headers) + 1
+	if attempt > retry.MaxAttempts {
+		return false, nil
+	}
+
+	headers := make(amqp.Table, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[RetryCountHeader] = int32(attempt)
+
+	publishing := deliveryPublishing(msg)
+	publishing.Headers = headers
+
+	ctx, cancel := context.WithTimeout(r.ctx, retryPublishTimeout)
+	defer cancel()
+
+	err := r.publishWithConfirm(ctx, "", retryQueueName(queueOptions.Name, retry.delay(attempt)), publishing)
+	return true, err
+}
+
+// deliveryPublishing 复制消息的属性，用于重新发送
+func deliveryPublishing(msg amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
@@ -0,0 +1,41 @@
+package rmq
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryDelay(t *testing.T) {
+	o := RetryOptions{Delays: []time.Duration{time.Second, 10 * time.Second, time.Minute}}
+
+	want := []time.Duration{time.Second, 10 * time.Second, time.Minute, time.Minute}
+	for i, d := range want {
+		if got := o.delay(i + 1); got != d {
+			t.Fatalf("attempt %d: got %v want %v", i+1, got, d)
+		}
+	}
+
+	if got := (&RetryOptions{}).delay(3); got != time.Second {
+		t.Fatalf("default delay: got %v", got)
+	}
+}
+
+func TestRetryCount(t *testing.T) {
+	tests := []struct {
+		headers amqp.Table
+		want    int
+	}{
+		{nil, 0},
+		{amqp.Table{RetryCountHeader: int32(2)}, 2},
+		{amqp.Table{RetryCountHeader: int64(3)}, 3},
+		{amqp.Table{RetryCountHeader: "4"}, 4},
+	}
+
+	for _, tt := range tests {
+		if got := RetryCount(tt.headers); got != tt.want {
+			t.Fatalf("headers %v: got %d want %d", tt.headers, got, tt.want)
+		}
+	}
+}
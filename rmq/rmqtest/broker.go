@@ -0,0 +1,628 @@
+// Package rmqtest 提供内存中的rmq.Broker实现，用于在go test中测试基于rmq的代码，不需要rabbitmq
+package rmqtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunliang711/goutils/rmq"
+	"github.com/sunliang711/goutils/rmq/internal/protocol"
+)
+
+const (
+	// maxFlushDeliveries 一次Flush最多投递的消息数量，避免一直requeue的消息导致死循环
+	maxFlushDeliveries = 10000
+)
+
+// ErrFlushLimit Flush投递的消息数量超过限制，通常是handler一直返回error并且requeue
+var ErrFlushLimit = errors.New("flush limit exceeded")
+
+// Message Publish发送的消息
+type Message struct {
+	Exchange   string
+	RoutingKey string
+	Publishing amqp.Publishing
+}
+
+type queue struct {
+	name      string
+	args      amqp.Table
+	messages  []amqp.Delivery
+	consumers []*consumer
+	next      int // 多个消费者时轮询投递
+}
+
+type binding struct {
+	exchange string
+	queue    string
+	key      string
+	args     amqp.Table
+}
+
+type consumer struct {
+	queue     *queue
+	config    rmq.ConsumerConfig
+	manualAck bool // AddConsumer添加的消费者，handler自己ack
+	unacked   int
+}
+
+type unackedMessage struct {
+	consumer *consumer
+	msg      amqp.Delivery
+}
+
+// Broker 内存中的rmq.Broker实现
+// 支持direct、topic(*和#通配符)、fanout、headers路由，默认exchange("")按队列名称路由，没有声明的exchange按topic路由
+// 消息不会自动投递，调用Flush时在当前goroutine中依次投递给消费者，所以测试结果是确定的
+// ack、nack和死信的处理和rabbitmq相同，重新入队的消息放到队列末尾
+// 配置了重试的队列不等待延迟时间，直接重新入队，超过最大次数后进入死信队列
+// 设置了x-message-ttl并且没有消费者的队列(例如PublishDelayed的等待队列)中的消息在Flush时立即过期，按死信参数发送
+// 不支持消息的Expiration和exchange之间的绑定
+type Broker struct {
+	mux         sync.Mutex
+	exchanges   map[string]string // exchange name -> type
+	queues      map[string]*queue
+	order       []*queue // 按声明顺序投递
+	bindings    []binding
+	producers   map[string]rmq.PublishOptions
+	middlewares []rmq.Middleware
+	published   []Message
+	unacked     map[uint64]*unackedMessage
+	tag         uint64
+	generated   int
+	connected   bool
+	closed      bool
+}
+
+var _ rmq.Broker = (*Broker)(nil)
+
+func NewBroker() *Broker {
+	return &Broker{
+		exchanges: make(map[string]string),
+		queues:    make(map[string]*queue),
+		producers: make(map[string]rmq.PublishOptions),
+		unacked:   make(map[uint64]*unackedMessage),
+	}
+}
+
+// AddProducer 声明exchange，defaults为向该exchange发送消息时的默认参数
+func (b *Broker) AddProducer(exchangeName string, exchangeOptions rmq.ExchangeOptions, defaults ...rmq.PublishOption) error {
+	var options rmq.PublishOptions
+	for _, opt := range defaults {
+		opt(&options)
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.exchanges[exchangeName] = exchangeOptions.Type
+	b.producers[exchangeName] = options
+	return nil
+}
+
+// AddConsumer 添加消费者，handler需要自己ack/nack消息
+func (b *Broker) AddConsumer(exchangeName string, topic string, handler rmq.MessageHandlerFunc, queueOptions rmq.QueueOptions, consumeOptions rmq.ConsumeOptions) error {
+	if handler == nil {
+		return fmt.Errorf("exchange %s handler is nil", exchangeName)
+	}
+
+	return b.addConsumer(exchangeName, rmq.ConsumerConfig{
+		Handler: func(ctx context.Context, msg amqp.Delivery) error {
+			handler(msg)
+			return nil
+		},
+		Topic:          topic,
+		QueueOptions:   queueOptions,
+		ConsumeOptions: consumeOptions,
+	}, true)
+}
+
+// AddHandler 添加消费者，handler返回nil时ack消息，返回error时nack消息
+func (b *Broker) AddHandler(exchangeName string, topic string, handler rmq.HandlerFunc, queueOptions rmq.QueueOptions, consumeOptions rmq.ConsumeOptions) error {
+	if handler == nil {
+		return fmt.Errorf("exchange %s handler is nil", exchangeName)
+	}
+
+	return b.addConsumer(exchangeName, rmq.ConsumerConfig{
+		Handler:        handler,
+		Topic:          topic,
+		QueueOptions:   queueOptions,
+		ConsumeOptions: consumeOptions,
+	}, false)
+}
+
+// AddConsumerConfig 使用完整的ConsumerConfig添加消费者
+func (b *Broker) AddConsumerConfig(exchangeName string, config rmq.ConsumerConfig) error {
+	if config.Handler == nil {
+		return fmt.Errorf("exchange %s handler is nil", exchangeName)
+	}
+
+	return b.addConsumer(exchangeName, config, false)
+}
+
+// addConsumer 立即声明队列和绑定，Connect之后开始投递
+func (b *Broker) addConsumer(exchangeName string, config rmq.ConsumerConfig, manualAck bool) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if config.ExchangeOptions != nil {
+		b.exchanges[exchangeName] = config.ExchangeOptions.Type
+	}
+
+	queueOptions := config.QueueOptions
+	args := queueOptions.DeclareArguments()
+	if args == nil {
+		args = make(amqp.Table)
+	}
+
+	if retry := queueOptions.Retry; retry != nil {
+		if queueOptions.Name == "" {
+			return fmt.Errorf("retry needs a named queue")
+		}
+		dlq := retry.DeadLetterQueueName(queueOptions.Name)
+		b.declareQueue(dlq, nil)
+		args[protocol.HeaderDeadLetterExchange] = ""
+		args[protocol.HeaderDeadLetterRoutingKey] = dlq
+	}
+
+	name := queueOptions.Name
+	if name == "" {
+		b.generated++
+		name = fmt.Sprintf("amq.gen-%d", b.generated)
+	}
+	q := b.declareQueue(name, args)
+
+	if exchangeName != "" {
+		for _, key := range config.RoutingKeys() {
+			b.bindings = append(b.bindings, binding{exchange: exchangeName, queue: name, key: key, args: queueOptions.BindArgs})
+		}
+	}
+
+	q.consumers = append(q.consumers, &consumer{queue: q, config: config, manualAck: manualAck})
+	return nil
+}
+
+// Use 添加全局中间件，在消费者自己的中间件之前执行
+func (b *Broker) Use(middlewares ...rmq.Middleware) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.middlewares = append(b.middlewares, middlewares...)
+}
+
+// DeclareExchange 声明exchange，kind为direct、topic、fanout或headers
+func (b *Broker) DeclareExchange(name string, kind string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.exchanges[name] = kind
+}
+
+// DeclareQueue 声明没有消费者的队列，用于在测试中检查路由到该队列的消息
+func (b *Broker) DeclareQueue(name string, args amqp.Table) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.declareQueue(name, args)
+}
+
+// Bind 把队列绑定到exchange，args用于headers exchange
+func (b *Broker) Bind(queueName, exchange, routingKey string, args amqp.Table) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.bindings = append(b.bindings, binding{exchange: exchange, queue: queueName, key: routingKey, args: args})
+}
+
+func (b *Broker) declareQueue(name string, args amqp.Table) *queue {
+	if q, ok := b.queues[name]; ok {
+		return q
+	}
+
+	q := &queue{name: name, args: args}
+	b.queues[name] = q
+	b.order = append(b.order, q)
+	return q
+}
+
+func (b *Broker) Connect() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("rabbitmq closed")
+	}
+	if b.connected {
+		return fmt.Errorf("rabbitmq already connected")
+	}
+	b.connected = true
+	return nil
+}
+
+// Publish 把消息路由到绑定的队列，没有匹配的队列时丢弃消息，Connect之前返回rmq.ErrNotConnected
+func (b *Broker) Publish(exchange, routingKey string, body []byte, opts ...rmq.PublishOption) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.connected {
+		return rmq.ErrNotConnected
+	}
+
+	publishing := b.publishing(exchange, body, opts...)
+	b.published = append(b.published, Message{Exchange: exchange, RoutingKey: routingKey, Publishing: publishing})
+	b.route(exchange, routingKey, publishing)
+	return nil
+}
+
+// publishing 使用exchange的默认参数和opts生成消息
+func (b *Broker) publishing(exchange string, body []byte, opts ...rmq.PublishOption) amqp.Publishing {
+	options := b.producers[exchange]
+	if options.Headers != nil {
+		headers := make(amqp.Table, len(options.Headers))
+		for k, v := range options.Headers {
+			headers[k] = v
+		}
+		options.Headers = headers
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options.Publishing(body)
+}
+
+// PublishWithConfirm 和Publish相同，exchange不存在或者没有匹配的队列时也返回nil
+func (b *Broker) PublishWithConfirm(ctx context.Context, exchange, routingKey string, body []byte, opts ...rmq.PublishOption) error {
+	return b.Publish(exchange, routingKey, body, opts...)
+}
+
+// PublishDelayed 和rmq.RabbitMQ相同，把消息发送到exchange、routing key和delay对应的等待队列，Flush时过期并路由到exchange
+// 不等待delay，Published中记录的是调用时的exchange和routing key
+// exchange为x-delayed-message类型时直接路由到exchange
+func (b *Broker) PublishDelayed(exchange, routingKey string, body []byte, delay time.Duration, opts ...rmq.PublishOption) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.connected {
+		return rmq.ErrNotConnected
+	}
+
+	publishing := b.publishing(exchange, body, opts...)
+	b.published = append(b.published, Message{Exchange: exchange, RoutingKey: routingKey, Publishing: publishing})
+	if delay <= 0 || b.exchanges[exchange] == rmq.ExchangeDelayedMessage {
+		b.route(exchange, routingKey, publishing)
+		return nil
+	}
+
+	name := protocol.DelayQueueName(exchange, routingKey, delay)
+	b.declareQueue(name, protocol.DelayQueueArguments(exchange, routingKey, delay))
+	b.route("", name, publishing)
+	return nil
+}
+
+func (b *Broker) Close() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.connected = false
+	b.closed = true
+}
+
+// route 把消息放入匹配的队列，每个队列最多一份
+func (b *Broker) route(exchange, routingKey string, publishing amqp.Publishing) {
+	var matched []*queue
+	if exchange == "" {
+		if q, ok := b.queues[routingKey]; ok {
+			matched = append(matched, q)
+		}
+	}
+
+	kind := b.exchanges[exchange]
+	for _, binding := range b.bindings {
+		if binding.exchange != exchange || !match(kind, binding, routingKey, publishing.Headers) {
+			continue
+		}
+		if q, ok := b.queues[binding.queue]; ok && !contains(matched, q) {
+			matched = append(matched, q)
+		}
+	}
+
+	for _, q := range matched {
+		q.messages = append(q.messages, delivery(exchange, routingKey, publishing))
+	}
+}
+
+func contains(queues []*queue, q *queue) bool {
+	for _, v := range queues {
+		if v == q {
+			return true
+		}
+	}
+	return false
+}
+
+func delivery(exchange, routingKey string, publishing amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{
+		Headers:         publishing.Headers,
+		ContentType:     publishing.ContentType,
+		ContentEncoding: publishing.ContentEncoding,
+		DeliveryMode:    publishing.DeliveryMode,
+		Priority:        publishing.Priority,
+		CorrelationId:   publishing.CorrelationId,
+		ReplyTo:         publishing.ReplyTo,
+		Expiration:      publishing.Expiration,
+		MessageId:       publishing.MessageId,
+		Timestamp:       publishing.Timestamp,
+		Type:            publishing.Type,
+		UserId:          publishing.UserId,
+		AppId:           publishing.AppId,
+		Exchange:        exchange,
+		RoutingKey:      routingKey,
+		Body:            publishing.Body,
+	}
+}
+
+// Flush 把队列中的消息投递给消费者，直到所有有消费者的队列都为空或者消费者达到Prefetch
+// handler中发送的消息、重新入队和重试的消息也会在本次Flush中投递，返回投递的消息数量
+func (b *Broker) Flush() (int, error) {
+	for n := 0; ; n++ {
+		if n >= maxFlushDeliveries {
+			return n, ErrFlushLimit
+		}
+
+		c, msg, handler, ok := b.next()
+		if !ok {
+			return n, nil
+		}
+		b.handle(c, msg, handler)
+	}
+}
+
+// next 取出下一条需要投递的消息
+func (b *Broker) next() (*consumer, amqp.Delivery, rmq.HandlerFunc, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.connected {
+		return nil, amqp.Delivery{}, nil, false
+	}
+
+	b.expire()
+	for _, q := range b.order {
+		if len(q.messages) == 0 {
+			continue
+		}
+
+		c := q.available()
+		if c == nil {
+			continue
+		}
+
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+
+		b.tag++
+		msg.DeliveryTag = b.tag
+		msg.Acknowledger = &acknowledger{broker: b}
+		if !c.config.ConsumeOptions.AutoAck {
+			c.unacked++
+			b.unacked[msg.DeliveryTag] = &unackedMessage{consumer: c, msg: msg}
+		}
+
+		// 和rmq.RabbitMQ相同，全局中间件在消费者自己的中间件之前执行，panic转换为*rmq.PanicError
+		middlewares := append([]rmq.Middleware{rmq.Recovery()}, b.middlewares...)
+		handler := rmq.Chain(c.config.Handler, append(middlewares, c.config.Middlewares...)...)
+		return c, msg, handler, true
+	}
+
+	return nil, amqp.Delivery{}, nil, false
+}
+
+// expire 设置了x-message-ttl并且没有消费者的队列中的消息全部过期，发送到死信exchange
+// 过期的消息可能进入另一个等待队列，所以重复直到没有过期的消息
+func (b *Broker) expire() {
+	for n := 0; n < maxFlushDeliveries; n++ {
+		expired := false
+		for _, q := range b.order {
+			if _, ok := q.args[protocol.HeaderMessageTTL]; !ok || len(q.consumers) > 0 || len(q.messages) == 0 {
+				continue
+			}
+
+			messages := q.messages
+			q.messages = nil
+			for _, msg := range messages {
+				b.deadLetter(q, msg)
+			}
+			expired = true
+		}
+		if !expired {
+			return
+		}
+	}
+}
+
+// available 轮询返回未ack消息数量没有达到Prefetch的消费者
+func (q *queue) available() *consumer {
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		prefetch := c.config.ConsumeOptions.Prefetch
+		if prefetch > 0 && c.unacked >= prefetch {
+			continue
+		}
+		q.next = (q.next + i + 1) % len(q.consumers)
+		return c
+	}
+	return nil
+}
+
+// handle 调用handler，按照和rmq.RabbitMQ相同的规则ack/nack消息
+func (b *Broker) handle(c *consumer, msg amqp.Delivery, handler rmq.HandlerFunc) {
+	err := handler(rmq.ContextWithDelivery(context.Background(), &msg), msg)
+	if c.config.ConsumeOptions.AutoAck || c.manualAck {
+		return
+	}
+	if err == nil {
+		msg.Ack(false)
+		return
+	}
+
+	requeue, explicit := protocol.NackDecision(err, c.config.ConsumeOptions.NackPolicy == rmq.NackRequeue)
+	if !explicit && c.config.QueueOptions.Retry != nil {
+		if b.retry(c, msg) {
+			msg.Ack(false)
+			return
+		}
+		requeue = false
+	}
+	msg.Nack(false, requeue)
+}
+
+// retry 增加重试次数后直接放回队列，返回false表示已经达到最大重试次数
+func (b *Broker) retry(c *consumer, msg amqp.Delivery) bool {
+	attempt := rmq.RetryCount(msg.Headers) + 1
+	if attempt > c.config.QueueOptions.Retry.MaxAttempts {
+		return false
+	}
+
+	headers := make(amqp.Table, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[rmq.RetryCountHeader] = int32(attempt)
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	retried := msg
+	retried.Headers = headers
+	retried.Redelivered = false
+	retried.Acknowledger = nil
+	retried.DeliveryTag = 0
+	c.queue.messages = append(c.queue.messages, retried)
+	return true
+}
+
+// settle ack或nack消息，requeue为false时按照队列的死信参数发送到死信exchange
+func (b *Broker) settle(tag uint64, multiple bool, ack bool, requeue bool) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if _, ok := b.unacked[tag]; !ok {
+		return fmt.Errorf("unknown delivery tag: %d", tag)
+	}
+
+	tags := []uint64{tag}
+	if multiple {
+		tags = tags[:0]
+		for t := range b.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+	}
+
+	for _, t := range tags {
+		unacked := b.unacked[t]
+		delete(b.unacked, t)
+		unacked.consumer.unacked--
+
+		if ack {
+			continue
+		}
+
+		q := unacked.consumer.queue
+		msg := unacked.msg
+		msg.Acknowledger = nil
+		msg.DeliveryTag = 0
+		if requeue {
+			msg.Redelivered = true
+			q.messages = append(q.messages, msg)
+			continue
+		}
+		b.deadLetter(q, msg)
+	}
+	return nil
+}
+
+// deadLetter 队列配置了x-dead-letter-exchange时发送到死信exchange，否则丢弃
+func (b *Broker) deadLetter(q *queue, msg amqp.Delivery) {
+	exchange, ok := q.args[protocol.HeaderDeadLetterExchange].(string)
+	if !ok {
+		return
+	}
+
+	routingKey := msg.RoutingKey
+	if key, ok := q.args[protocol.HeaderDeadLetterRoutingKey].(string); ok {
+		routingKey = key
+	}
+
+	publishing := amqp.Publishing{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+	b.route(exchange, routingKey, publishing)
+}
+
+// Published 返回所有Publish发送的消息，包括没有路由到队列的消息
+func (b *Broker) Published() []Message {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return append([]Message(nil), b.published...)
+}
+
+// Messages 返回队列中还没有投递的消息
+func (b *Broker) Messages(queueName string) []amqp.Delivery {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return nil
+	}
+	return append([]amqp.Delivery(nil), q.messages...)
+}
+
+// Unacked 返回队列中已经投递但还没有ack/nack的消息数量
+func (b *Broker) Unacked(queueName string) int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	n := 0
+	for _, unacked := range b.unacked {
+		if unacked.consumer.queue.name == queueName {
+			n++
+		}
+	}
+	return n
+}
+
+type acknowledger struct {
+	broker *Broker
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	return a.broker.settle(tag, multiple, true, false)
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.broker.settle(tag, multiple, false, requeue)
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	return a.broker.settle(tag, false, false, requeue)
+}
@@ -0,0 +1,199 @@
+package rmqtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sunliang711/goutils/rmq"
+)
+
+func TestBrokerRouting(t *testing.T) {
+	b := NewBroker()
+	b.AddProducer("orders", rmq.ExchangeOptions{Type: amqp.ExchangeTopic})
+	b.AddProducer("events", rmq.ExchangeOptions{Type: amqp.ExchangeFanout})
+
+	var created, all, fanout []string
+	b.AddHandler("orders", "order.created", func(ctx context.Context, msg amqp.Delivery) error {
+		created = append(created, msg.RoutingKey)
+		return nil
+	}, rmq.QueueOptions{Name: "created"}, rmq.ConsumeOptions{})
+	b.AddHandler("orders", "order.#", func(ctx context.Context, msg amqp.Delivery) error {
+		all = append(all, msg.RoutingKey)
+		return nil
+	}, rmq.QueueOptions{Name: "all"}, rmq.ConsumeOptions{})
+	b.AddHandler("events", "", func(ctx context.Context, msg amqp.Delivery) error {
+		fanout = append(fanout, string(msg.Body))
+		return nil
+	}, rmq.QueueOptions{}, rmq.ConsumeOptions{})
+
+	if err := b.Publish("orders", "order.created", nil); !errors.Is(err, rmq.ErrNotConnected) {
+		t.Fatalf("publish before connect: %v", err)
+	}
+
+	b.Connect()
+	b.Publish("orders", "order.created", nil)
+	b.Publish("orders", "order.paid.v2", nil)
+	b.Publish("events", "ignored", []byte("e1"))
+
+	if n, err := b.Flush(); err != nil || n != 4 {
+		t.Fatalf("flush: %d %v", n, err)
+	}
+	if len(created) != 1 || len(all) != 2 || len(fanout) != 1 || fanout[0] != "e1" {
+		t.Fatalf("created: %v all: %v fanout: %v", created, all, fanout)
+	}
+	if len(b.Published()) != 3 {
+		t.Fatalf("published: %d", len(b.Published()))
+	}
+}
+
+func TestBrokerNackAndDeadLetter(t *testing.T) {
+	b := NewBroker()
+	b.AddProducer("orders", rmq.ExchangeOptions{Type: amqp.ExchangeDirect})
+	b.DeclareExchange("dlx", amqp.ExchangeFanout)
+	b.DeclareQueue("dead", nil)
+	b.Bind("dead", "dlx", "", nil)
+
+	attempts := 0
+	b.AddHandler("orders", "pay", func(ctx context.Context, msg amqp.Delivery) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("temporary")
+		}
+		return rmq.Discard(errors.New("invalid"))
+	}, rmq.QueueOptions{Name: "pay", Arguments: amqp.Table{"x-dead-letter-exchange": "dlx"}}, rmq.ConsumeOptions{})
+	b.Connect()
+
+	b.Publish("orders", "pay", []byte("1"))
+	if _, err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := b.Messages("dead")
+	if attempts != 2 || len(dead) != 1 || string(dead[0].Body) != "1" {
+		t.Fatalf("attempts: %d dead: %v", attempts, dead)
+	}
+	if b.Unacked("pay") != 0 {
+		t.Fatalf("unacked: %d", b.Unacked("pay"))
+	}
+}
+
+func TestBrokerRetry(t *testing.T) {
+	b := NewBroker()
+	b.AddProducer("orders", rmq.ExchangeOptions{Type: amqp.ExchangeTopic})
+
+	attempts := 0
+	b.AddHandler("orders", "order.*", func(ctx context.Context, msg amqp.Delivery) error {
+		attempts++
+		return errors.New("failed")
+	}, rmq.QueueOptions{Name: "orders", Retry: &rmq.RetryOptions{MaxAttempts: 2}}, rmq.ConsumeOptions{})
+	b.Connect()
+
+	b.Publish("orders", "order.created", []byte("1"))
+	if _, err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := b.Messages("orders.dlq")
+	if attempts != 3 || len(dead) != 1 || rmq.RetryCount(dead[0].Headers) != 2 {
+		t.Fatalf("attempts: %d dead: %v", attempts, dead)
+	}
+}
+
+func TestBrokerManualAck(t *testing.T) {
+	b := NewBroker()
+
+	var msgs []amqp.Delivery
+	b.AddConsumer("orders", "#", func(msg amqp.Delivery) {
+		msgs = append(msgs, msg)
+	}, rmq.QueueOptions{Name: "orders"}, rmq.ConsumeOptions{Prefetch: 1})
+	b.Connect()
+
+	b.Publish("orders", "a", nil)
+	b.Publish("orders", "b", nil)
+	if n, _ := b.Flush(); n != 1 || b.Unacked("orders") != 1 {
+		t.Fatalf("flush: %d unacked: %d", n, b.Unacked("orders"))
+	}
+
+	msgs[0].Nack(false, true)
+	if n, _ := b.Flush(); n != 1 {
+		t.Fatalf("flush: %d", n)
+	}
+	msgs[1].Ack(false)
+	b.Flush()
+	msgs[2].Ack(false)
+
+	if len(msgs) != 3 || msgs[1].RoutingKey != "b" || msgs[2].RoutingKey != "a" || !msgs[2].Redelivered {
+		t.Fatalf("msgs: %v", msgs)
+	}
+	if b.Unacked("orders") != 0 {
+		t.Fatalf("unacked: %d", b.Unacked("orders"))
+	}
+}
+
+func TestBrokerRequeueLoop(t *testing.T) {
+	b := NewBroker()
+	b.AddHandler("orders", "#", func(ctx context.Context, msg amqp.Delivery) error {
+		return errors.New("failed")
+	}, rmq.QueueOptions{}, rmq.ConsumeOptions{})
+	b.Connect()
+
+	b.Publish("orders", "a", nil)
+	if _, err := b.Flush(); !errors.Is(err, ErrFlushLimit) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestBrokerTypedConsumer(t *testing.T) {
+	type order struct {
+		Id int `json:"id"`
+	}
+
+	b := NewBroker()
+	var got order
+	var traceID string
+	b.Use(rmq.Tracing())
+	rmq.AddTypedConsumer(b, "orders", "#", func(ctx context.Context, v order, msg amqp.Delivery) error {
+		got = v
+		traceID = rmq.TraceIDFromContext(ctx)
+		return nil
+	}, rmq.QueueOptions{}, rmq.ConsumeOptions{})
+	b.Connect()
+
+	ctx := rmq.ContextWithTraceID(context.Background(), "t1")
+	if err := rmq.PublishJSON(b, "orders", "order.created", order{Id: 7}, rmq.WithTraceContext(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	b.Flush()
+
+	if got.Id != 7 || traceID != "t1" {
+		t.Fatalf("got %v trace id %s", got, traceID)
+	}
+}
+
+func TestBrokerPublishDelayed(t *testing.T) {
+	b := NewBroker()
+	b.AddProducer("orders", rmq.ExchangeOptions{Type: amqp.ExchangeTopic})
+
+	var received []string
+	b.AddHandler("orders", "order.#", func(ctx context.Context, msg amqp.Delivery) error {
+		received = append(received, string(msg.Body))
+		return nil
+	}, rmq.QueueOptions{Name: "orders"}, rmq.ConsumeOptions{})
+	b.Connect()
+
+	b.PublishDelayed("orders", "order.created", []byte("d1"), time.Second)
+	b.PublishDelayed("orders", "order.created", []byte("d2"), 2*time.Second)
+	if len(b.Messages("orders")) != 0 {
+		t.Fatalf("delayed message routed before expired")
+	}
+
+	if n, err := b.Flush(); err != nil || n != 2 {
+		t.Fatalf("flush: %d %v", n, err)
+	}
+	if len(received) != 2 || received[0] != "d1" || received[1] != "d2" {
+		t.Fatalf("received: %v", received)
+	}
+}
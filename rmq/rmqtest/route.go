@@ -0,0 +1,73 @@
+package rmqtest
+
+import (
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// match 判断消息是否匹配绑定，kind为空时按topic处理
+func match(kind string, binding binding, routingKey string, headers amqp.Table) bool {
+	switch kind {
+	case amqp.ExchangeDirect:
+		return binding.key == routingKey
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeHeaders:
+		return MatchHeaders(binding.args, headers)
+	default:
+		return MatchTopic(binding.key, routingKey)
+	}
+}
+
+// MatchTopic 判断routing key是否匹配topic exchange的绑定
+// 以.分隔单词，*匹配一个单词，#匹配零个或多个单词
+func MatchTopic(pattern, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+// MatchHeaders 判断消息头是否匹配headers exchange的绑定参数
+// x-match为any时任意一个参数相等即匹配，否则需要所有参数相等，x-开头的参数不参与匹配
+func MatchHeaders(args amqp.Table, headers amqp.Table) bool {
+	matchAny := args["x-match"] == "any"
+
+	matched := 0
+	total := 0
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		total++
+
+		// 比较格式化后的值，避免int和int32等类型不同导致不相等
+		if h, ok := headers[k]; ok && fmt.Sprint(h) == fmt.Sprint(v) {
+			matched++
+		}
+	}
+
+	if matchAny {
+		return matched > 0
+	}
+	return matched == total
+}
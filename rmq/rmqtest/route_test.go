@@ -0,0 +1,52 @@
+package rmqtest
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"order.created", "order.created", true},
+		{"order.created", "order.paid", false},
+		{"order.*", "order.created", true},
+		{"order.*", "order.created.v2", false},
+		{"order.#", "order", true},
+		{"order.#", "order.created.v2", true},
+		{"#.v2", "order.created.v2", true},
+		{"*.created.#", "order.created", true},
+		{"#", "anything.at.all", true},
+		{"*", "a.b", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.key); got != tt.want {
+			t.Fatalf("pattern %s key %s: got %v want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	headers := amqp.Table{"format": "pdf", "version": int32(2)}
+
+	tests := []struct {
+		args amqp.Table
+		want bool
+	}{
+		{amqp.Table{"format": "pdf", "version": 2}, true},
+		{amqp.Table{"format": "pdf", "type": "report"}, false},
+		{amqp.Table{"x-match": "any", "format": "pdf", "type": "report"}, true},
+		{amqp.Table{"x-match": "any", "type": "report"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchHeaders(tt.args, headers); got != tt.want {
+			t.Fatalf("args %v: got %v want %v", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package rmq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// directReplyTo rabbitmq的direct reply-to伪队列，不需要声明回调队列
+	directReplyTo = "amq.rabbitmq.reply-to"
+
+	// RPCErrorHeader 服务端handler返回error时，通过该消息头把错误信息返回给调用方
+	RPCErrorHeader = "x-rpc-error"
+)
+
+// RPCHandlerFunc 返回值会发送到请求的ReplyTo，返回的error会以RPCError返回给调用方
+type RPCHandlerFunc func(ctx context.Context, msg amqp.Delivery) ([]byte, error)
+
+// RPCError 服务端handler返回的错误
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error: %s", e.Message)
+}
+
+// rpcClient 每个连接一个，在同一个channel上消费direct reply-to并发送请求
+type rpcClient struct {
+	ch      *amqp.Channel
+	mux     sync.Mutex
+	pending map[string]chan rpcResult
+	closed  bool // dispatch已经退出，不会再收到回复
+}
+
+// rpcResult 回复，或者请求被broker退回时的错误
+type rpcResult struct {
+	reply amqp.Delivery
+	err   error
+}
+
+// rpcChannel 返回当前连接的rpcClient，不存在时创建
+func (r *RabbitMQ) rpcChannel() (*rpcClient, error) {
+	r.rpcMux.Lock()
+	defer r.rpcMux.Unlock()
+
+	if r.rpc != nil && !r.rpc.ch.IsClosed() {
+		return r.rpc, nil
+	}
+
+	r.chMux.RLock()
+	conn := r.conn
+	r.chMux.RUnlock()
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("open rpc channel error: %w", err)
+	}
+
+	replies, err := ch.Consume(
+		directReplyTo, // queue
+		"",            // consumer
+		true,          // auto-ack direct reply-to必须为true
+		false,         // exclusive
+		false,         // no-local
+		false,         // no-wait
+		nil,           // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("consume %s error: %w", directReplyTo, err)
+	}
+
+	client := &rpcClient{
+		ch:      ch,
+		pending: make(map[string]chan rpcResult),
+	}
+	// 请求以mandatory方式发送，没有队列可以路由时被退回
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	go client.dispatch(replies, returns)
+
+	r.rpc = client
+	return client, nil
+}
+
+// dispatch 按CorrelationId把回复和退回的请求分发给调用方，channel关闭时通知所有等待的调用方
+func (c *rpcClient) dispatch(replies <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	for replies != nil {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				replies = nil
+				continue
+			}
+			c.deliver(reply.CorrelationId, rpcResult{reply: reply})
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.deliver(ret.CorrelationId, rpcResult{err: &ReturnedError{
+				Exchange:   ret.Exchange,
+				RoutingKey: ret.RoutingKey,
+				ReplyCode:  ret.ReplyCode,
+				ReplyText:  ret.ReplyText,
+			}})
+		}
+	}
+
+	c.mux.Lock()
+	c.closed = true
+	for id, waiter := range c.pending {
+		close(waiter)
+		delete(c.pending, id)
+	}
+	c.mux.Unlock()
+}
+
+func (c *rpcClient) deliver(correlationId string, result rpcResult) {
+	c.mux.Lock()
+	waiter, ok := c.pending[correlationId]
+	delete(c.pending, correlationId)
+	c.mux.Unlock()
+
+	if ok {
+		waiter <- result
+	}
+}
+
+func (r *RabbitMQ) closeRPC() {
+	r.rpcMux.Lock()
+	defer r.rpcMux.Unlock()
+
+	if r.rpc == nil {
+		return
+	}
+	if err := r.rpc.ch.Close(); err != nil && err != amqp.ErrClosed {
+		r.logger.Warn("Failed to close rpc channel: %s", err)
+	}
+	r.rpc = nil
+}
+
+func newCorrelationId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Call 发送请求并等待回复，使用direct reply-to接收回复，按CorrelationId关联请求和回复
+// ctx用于控制超时，服务端handler返回error时返回*RPCError，请求没有队列可以路由时返回*ReturnedError
+func (r *RabbitMQ) Call(ctx context.Context, exchange, routingKey string, body []byte, opts ...PublishOption) ([]byte, error) {
+	client, err := r.rpcChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	options := r.publishOptions(exchange, opts...)
+	options.CorrelationId = newCorrelationId()
+	options.ReplyTo = directReplyTo
+
+	waiter := make(chan rpcResult, 1)
+	client.mux.Lock()
+	if client.closed {
+		// dispatch已经退出(例如channel刚刚关闭)，不会收到回复
+		client.mux.Unlock()
+		return nil, ErrNotConnected
+	}
+	client.pending[options.CorrelationId] = waiter
+	client.mux.Unlock()
+
+	defer func() {
+		client.mux.Lock()
+		delete(client.pending, options.CorrelationId)
+		client.mux.Unlock()
+	}()
+
+	err = client.ch.PublishWithContext(
+		ctx,
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory
+		false,      // immediate
+		options.Publishing(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case result, ok := <-waiter:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		if result.err != nil {
+			return nil, result.err
+		}
+		if msg, ok := result.reply.Headers[RPCErrorHeader].(string); ok {
+			return nil, &RPCError{Message: msg}
+		}
+		return result.reply.Body, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AddRPCHandler 添加rpc服务端，handler的返回值发送到请求的ReplyTo
+// 回复发送成功后ack请求，发送失败时nack请求并重新入队
+// 回复不使用producer的默认参数，也不放入断线缓冲区，因为direct reply-to地址只在请求方原来的连接上有效
+func (r *RabbitMQ) AddRPCHandler(exchangeName string, topic string, handler RPCHandlerFunc, queueOptions QueueOptions, consumeOptions ConsumeOptions) error {
+	if handler == nil {
+		return fmt.Errorf("exchange %s rpc handler is nil", exchangeName)
+	}
+
+	return r.AddHandler(exchangeName, topic, func(ctx context.Context, msg amqp.Delivery) error {
+		body, err := handler(ctx, msg)
+		if msg.ReplyTo == "" {
+			return err
+		}
+
+		options := PublishOptions{CorrelationId: msg.CorrelationId}
+		if err != nil {
+			withFields(r.logger, "correlation_id", msg.CorrelationId, "reply_to", msg.ReplyTo).Warn("Handle rpc request error: %v", err)
+			WithHeader(RPCErrorHeader, err.Error())(&options)
+		}
+
+		// 通过默认exchange发送到ReplyTo
+		err = r.publish("", msg.ReplyTo, options.Publishing(body))
+		r.metrics.Published("", publishResult(err))
+		if err != nil {
+			return Requeue(fmt.Errorf("publish rpc reply to: %s error: %w", msg.ReplyTo, err))
+		}
+		return nil
+	}, queueOptions, consumeOptions)
+}
@@ -0,0 +1,43 @@
+package rmq
+
+import (
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRPCDispatch(t *testing.T) {
+	client := &rpcClient{pending: make(map[string]chan rpcResult)}
+	replies := make(chan amqp.Delivery)
+	returns := make(chan amqp.Return)
+
+	returned := make(chan rpcResult, 1)
+	replied := make(chan rpcResult, 1)
+	client.pending["1"] = returned
+	client.pending["2"] = replied
+
+	done := make(chan struct{})
+	go func() {
+		client.dispatch(replies, returns)
+		close(done)
+	}()
+
+	returns <- amqp.Return{CorrelationId: "1", RoutingKey: "missing", ReplyCode: amqp.NoRoute}
+	replies <- amqp.Delivery{CorrelationId: "2", Body: []byte("ok")}
+
+	var returnedErr *ReturnedError
+	if result := <-returned; !errors.As(result.err, &returnedErr) || returnedErr.RoutingKey != "missing" {
+		t.Fatalf("returned: %+v", result)
+	}
+	if result := <-replied; result.err != nil || string(result.reply.Body) != "ok" {
+		t.Fatalf("replied: %+v", result)
+	}
+
+	// channel关闭后不再接受新的请求
+	close(replies)
+	<-done
+	if !client.closed || len(client.pending) != 0 {
+		t.Fatalf("client not closed")
+	}
+}
@@ -0,0 +1,185 @@
+package rmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pelletier/go-toml/v2"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gopkg.in/yaml.v3"
+)
+
+// Topology 声明式的exchange、队列和绑定，每次连接(包括重连)时按顺序声明
+// 声明是幂等的，已经存在且参数相同时不会有任何影响
+type Topology struct {
+	Exchanges        []ExchangeDeclaration `mapstructure:"exchanges"`
+	Queues           []QueueOptions        `mapstructure:"queues"`
+	Bindings         []QueueBinding        `mapstructure:"bindings"`
+	ExchangeBindings []ExchangeBinding     `mapstructure:"exchange_bindings"`
+}
+
+type ExchangeDeclaration struct {
+	Name            string `mapstructure:"name"`
+	ExchangeOptions `mapstructure:",squash"`
+}
+
+// QueueBinding 把队列绑定到exchange，每个routing key一个绑定
+// headers类型的exchange忽略routing key，使用Arguments中的x-match和消息头匹配
+type QueueBinding struct {
+	Queue       string     `mapstructure:"queue"`
+	Exchange    string     `mapstructure:"exchange"`
+	RoutingKeys []string   `mapstructure:"routing_keys"`
+	NoWait      bool       `mapstructure:"no_wait"`
+	Arguments   amqp.Table `mapstructure:"arguments"`
+}
+
+// ExchangeBinding 把destination exchange绑定到source exchange
+type ExchangeBinding struct {
+	Destination string     `mapstructure:"destination"`
+	Source      string     `mapstructure:"source"`
+	RoutingKeys []string   `mapstructure:"routing_keys"`
+	NoWait      bool       `mapstructure:"no_wait"`
+	Arguments   amqp.Table `mapstructure:"arguments"`
+}
+
+// LoadTopology 从配置文件(json、yaml、toml)中读取Topology，按扩展名选择格式
+// 不使用viper，因为viper会把key转换为小写，headers绑定的参数和消息头区分大小写
+func LoadTopology(file string) (Topology, error) {
+	var topology Topology
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return topology, fmt.Errorf("read topology file: %s error: %w", file, err)
+	}
+
+	var raw map[string]any
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".json":
+		// 数字保留为json.Number，由jsonNumberHook转换，否则整数会变成float64，以double类型声明参数
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		err = fmt.Errorf("unsupported file type: %s", ext)
+	}
+	if err != nil {
+		return topology, fmt.Errorf("parse topology file: %s error: %w", file, err)
+	}
+
+	// 和viper.Unmarshal相同的解码方式，支持"1m"格式的时间
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			jsonNumberHook,
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		Result:           &topology,
+	})
+	if err != nil {
+		return topology, err
+	}
+	if err = decoder.Decode(raw); err != nil {
+		return topology, fmt.Errorf("decode topology file: %s error: %w", file, err)
+	}
+
+	return topology, nil
+}
+
+// jsonNumberHook 把json.Number转换为int64，不是整数时转换为float64，和yaml、toml解析的结果相同
+func jsonNumberHook(from reflect.Type, to reflect.Type, data any) (any, error) {
+	number, ok := data.(json.Number)
+	if !ok {
+		return data, nil
+	}
+	if n, err := number.Int64(); err == nil {
+		return n, nil
+	}
+	return number.Float64()
+}
+
+// AddTopology 添加需要声明的exchange、队列和绑定，在Connect之前调用
+func (r *RabbitMQ) AddTopology(topology Topology) {
+	r.config.Topology.Exchanges = append(r.config.Topology.Exchanges, topology.Exchanges...)
+	r.config.Topology.Queues = append(r.config.Topology.Queues, topology.Queues...)
+	r.config.Topology.Bindings = append(r.config.Topology.Bindings, topology.Bindings...)
+	r.config.Topology.ExchangeBindings = append(r.config.Topology.ExchangeBindings, topology.ExchangeBindings...)
+}
+
+// routingKeys 没有routing key时使用空字符串绑定一次(fanout、headers)
+func routingKeys(keys []string) []string {
+	if len(keys) == 0 {
+		return []string{""}
+	}
+	return keys
+}
+
+func (r *RabbitMQ) declareExchange(ch *amqp.Channel, name string, options ExchangeOptions) error {
+	withFields(r.logger, "exchange", name).Info("Declare exchange")
+	err := ch.ExchangeDeclare(
+		name,              // name
+		options.Type,      // type
+		options.Durable,   // durable
+		options.AutoDel,   // auto-deleted
+		options.Internal,  // internal
+		options.NoWait,    // no-wait
+		options.Arguments, // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("declare exchange: %s error: %w", name, err)
+	}
+	return nil
+}
+
+// declareTopology 按exchange、队列、队列绑定、exchange绑定的顺序声明
+func (r *RabbitMQ) declareTopology(ch *amqp.Channel, topology *Topology) error {
+	for _, exchange := range topology.Exchanges {
+		if err := r.declareExchange(ch, exchange.Name, exchange.ExchangeOptions); err != nil {
+			return err
+		}
+	}
+
+	for _, queue := range topology.Queues {
+		var err error
+		if queue.Retry != nil {
+			if queue, err = r.declareRetryTopology(queue); err != nil {
+				return err
+			}
+		}
+		if _, err = r.declareQueue(queue); err != nil {
+			return err
+		}
+	}
+
+	for _, binding := range topology.Bindings {
+		for _, key := range routingKeys(binding.RoutingKeys) {
+			withFields(r.logger, "queue", binding.Queue, "exchange", binding.Exchange, "routing_key", key).Info("Bind queue")
+			err := ch.QueueBind(binding.Queue, key, binding.Exchange, binding.NoWait, binding.Arguments)
+			if err != nil {
+				return fmt.Errorf("bind queue: %s to exchange: %s error: %w", binding.Queue, binding.Exchange, err)
+			}
+		}
+	}
+
+	for _, binding := range topology.ExchangeBindings {
+		for _, key := range routingKeys(binding.RoutingKeys) {
+			withFields(r.logger, "destination", binding.Destination, "exchange", binding.Source, "routing_key", key).Info("Bind exchange")
+			err := ch.ExchangeBind(binding.Destination, key, binding.Source, binding.NoWait, binding.Arguments)
+			if err != nil {
+				return fmt.Errorf("bind exchange: %s to exchange: %s error: %w", binding.Destination, binding.Source, err)
+			}
+		}
+	}
+
+	return nil
+}
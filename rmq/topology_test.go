@@ -0,0 +1,110 @@
+package rmq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadTopology(t *testing.T) {
+	topology, err := LoadTopology("examples/topology/topology.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(topology.Exchanges) != 3 || topology.Exchanges[0].Name != "orders" || topology.Exchanges[0].Type != "topic" || !topology.Exchanges[0].Durable {
+		t.Fatalf("exchanges: %+v", topology.Exchanges)
+	}
+
+	retry := topology.Queues[0].Retry
+	if retry == nil || retry.MaxAttempts != 3 || len(retry.Delays) != 3 || retry.Delays[2] != time.Minute {
+		t.Fatalf("retry: %+v", retry)
+	}
+
+	vip := topology.Queues[2]
+	if vip.Type != QueueQuorum || vip.MaxLength != 10000 || vip.Overflow != QueueOverflowRejectPublish || vip.MessageTTL != 24*time.Hour || !vip.SingleActiveConsumer {
+		t.Fatalf("typed queue options: %+v", vip)
+	}
+
+	if keys := topology.Bindings[0].RoutingKeys; len(keys) != 2 || keys[1] != "order.recreated" {
+		t.Fatalf("routing keys: %v", keys)
+	}
+	if topology.Bindings[2].Arguments["x-match"] != "all" {
+		t.Fatalf("headers binding arguments: %v", topology.Bindings[2].Arguments)
+	}
+
+	if len(topology.ExchangeBindings) != 1 || topology.ExchangeBindings[0].Source != "orders" {
+		t.Fatalf("exchange bindings: %+v", topology.ExchangeBindings)
+	}
+}
+
+func TestLoadTopologyHeaderCase(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "topology.yml")
+	os.WriteFile(file, []byte(`
+bindings:
+  - queue: orders.vip
+    exchange: orders.headers
+    arguments:
+      x-match: any
+      Tenant-Id: acme
+`), 0644)
+
+	topology, err := LoadTopology(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// headers绑定的参数区分大小写
+	if topology.Bindings[0].Arguments["Tenant-Id"] != "acme" {
+		t.Fatalf("headers binding arguments: %v", topology.Bindings[0].Arguments)
+	}
+}
+
+func TestLoadTopologyJSONNumber(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "topology.json")
+	os.WriteFile(file, []byte(`{
+  "queues": [
+    {"name": "orders", "max_length": 100, "arguments": {"x-message-ttl": 60000, "x-ratio": 0.5}}
+  ]
+}`), 0644)
+
+	topology, err := LoadTopology(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := topology.Queues[0]
+	// 整数参数需要以整数类型声明，double类型的x-message-ttl会被rabbitmq拒绝
+	if ttl, ok := queue.Arguments["x-message-ttl"].(int64); !ok || ttl != 60000 {
+		t.Fatalf("x-message-ttl: %T %v", queue.Arguments["x-message-ttl"], queue.Arguments["x-message-ttl"])
+	}
+	if ratio, ok := queue.Arguments["x-ratio"].(float64); !ok || ratio != 0.5 {
+		t.Fatalf("x-ratio: %T %v", queue.Arguments["x-ratio"], queue.Arguments["x-ratio"])
+	}
+	if queue.MaxLength != 100 {
+		t.Fatalf("max length: %d", queue.MaxLength)
+	}
+}
+
+func TestConsumerTopics(t *testing.T) {
+	tests := []struct {
+		config ConsumerConfig
+		want   []string
+	}{
+		{ConsumerConfig{}, []string{""}},
+		{ConsumerConfig{Topic: "a"}, []string{"a"}},
+		{ConsumerConfig{Topics: []string{"b", "c"}}, []string{"b", "c"}},
+		{ConsumerConfig{Topic: "a", Topics: []string{"b"}}, []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		got := tt.config.RoutingKeys()
+		if len(got) != len(tt.want) {
+			t.Fatalf("got %v want %v", got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("got %v want %v", got, tt.want)
+			}
+		}
+	}
+}
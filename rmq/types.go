@@ -2,55 +2,100 @@ package rmq
 
 import (
 	"context"
-	"log"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type Config struct {
-	URL          string
-	ReconnectSec int // 重连间隔
-	CaCertBytes  []byte
-	ClientCert   []byte
-	ClientKey    []byte
+	URL                  string
+	ReconnectSec         int         // 重连间隔，按指数退避增长
+	ReconnectMaxSec      int         // 最大重连间隔
+	ReconnectMaxAttempts int         // 最大重连次数，为0时不限制
+	OnStateChange        func(State) // 连接状态变化回调
+	Logger               Logger      // 日志，为空时使用标准库log输出到标准输出
+	Metrics              Metrics     // 指标，为空时不记录
+
+	PublishBufferSize   int            // 断线期间缓存的消息数量，为0时不缓存
+	PublishBufferPolicy OverflowPolicy // 缓冲区满时的处理方式
+	PublishSpoolFile    string         // 缓冲区消息写入的文件，为空时只缓存在内存中
+	PublishChannels     int            // 发送消息的channel数量，Publish和PublishWithConfirm各一个channel池，默认为1
+
+	CaCertBytes []byte
+	ClientCert  []byte
+	ClientKey   []byte
 
 	Producers map[string]ProducerConfig   // 用于生产消息, key为exchange name, value为配置信息，包括: 类型
 	Consumers map[string][]ConsumerConfig // 用于消费信息, key为exchange name, value为配置信息，包括: 类型,topics,handler
+	Topology  Topology                    // 每次连接时声明的exchange、队列和绑定
 }
 
 type ProducerConfig struct {
 	ExchangeOptions ExchangeOptions
-	// TODO: other options
+	PublishOptions  PublishOptions // 向该exchange发送消息时的默认参数，可以被Publish的opts覆盖
 }
 
 type ConsumerConfig struct {
-	// ExchangeOptions ExchangeOptions
+	Name            string           // 消费者名称，用于Pause/Resume，同时作为consumer tag，为空时使用队列名称
+	ExchangeOptions *ExchangeOptions // 非空时消费者也声明exchange，不依赖生产者先声明
 
-	Handler        MessageHandlerFunc // 消息处理handler
-	Topic          string             // type为topic|direct时的topics
+	Handler        HandlerFunc  // 消息处理handler
+	Middlewares    []Middleware // 该消费者的中间件，在全局中间件之后执行
+	Topic          string       // type为topic|direct时的topics
+	Topics         []string     // 多个routing key，和Topic合并
 	QueueOptions   QueueOptions
 	ConsumeOptions ConsumeOptions
+
+	manualAck bool // 由MessageHandlerFunc转换而来，handler自己ack，框架不做ack/nack
+}
+
+// name 消费者名称，为空时使用队列名称
+func (c *ConsumerConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.QueueOptions.Name
+}
+
+// RoutingKeys 合并Topic和Topics，都为空时使用空字符串绑定一次(fanout、headers)
+func (c *ConsumerConfig) RoutingKeys() []string {
+	var topics []string
+	if c.Topic != "" || len(c.Topics) == 0 {
+		topics = append(topics, c.Topic)
+	}
+	return append(topics, c.Topics...)
 }
 
 type ExchangeOptions struct {
-	Type      string     // "topic|direct" "fanout"
-	Durable   bool       // durable 如果设置为 true，交换机将在服务器重启后仍然存在
-	AutoDel   bool       // auto-deleted 如果设置为 true，当没有队列绑定到交换机时，交换机会被自动删除。
-	Internal  bool       // internal 如果设置为 true，交换机是内部使用的，不能被客户端直接发送消息。
-	NoWait    bool       // no-wait 如果设置为 true，不等待服务器的确认。
-	Arguments amqp.Table // arguments Table 类型，表示一个键值对的字典，用于指定交换机的额外参数。
+	Type      string     `mapstructure:"type"`        // "topic|direct" "fanout" "headers"
+	Durable   bool       `mapstructure:"durable"`     // durable 如果设置为 true，交换机将在服务器重启后仍然存在
+	AutoDel   bool       `mapstructure:"auto_delete"` // auto-deleted 如果设置为 true，当没有队列绑定到交换机时，交换机会被自动删除。
+	Internal  bool       `mapstructure:"internal"`    // internal 如果设置为 true，交换机是内部使用的，不能被客户端直接发送消息。
+	NoWait    bool       `mapstructure:"no_wait"`     // no-wait 如果设置为 true，不等待服务器的确认。
+	Arguments amqp.Table `mapstructure:"arguments"`   // arguments Table 类型，表示一个键值对的字典，用于指定交换机的额外参数。
 }
 
 type QueueOptions struct {
-	Name      string     // name 队列名称
-	Durable   bool       // durable 如果设置为 true，队列将在服务器重启后仍然存在。
-	AutoDel   bool       // auto-deleted 如果设置为 true，当没有消费者使用时，队列会被自动删除。
-	Exclusive bool       // exclusive 如果设置为 true，只有创建者可以使用的私有队列，断开后自动删除。
-	NoWait    bool       // no-wait 如果设置为 true，不等待服务器的确认。
-	Arguments amqp.Table // arguments Table 类型，表示一个键值对的字典，用于指定队列的额外参数。
+	Name      string     `mapstructure:"name"`        // name 队列名称
+	Durable   bool       `mapstructure:"durable"`     // durable 如果设置为 true，队列将在服务器重启后仍然存在。
+	AutoDel   bool       `mapstructure:"auto_delete"` // auto-deleted 如果设置为 true，当没有消费者使用时，队列会被自动删除。
+	Exclusive bool       `mapstructure:"exclusive"`   // exclusive 如果设置为 true，只有创建者可以使用的私有队列，断开后自动删除。
+	NoWait    bool       `mapstructure:"no_wait"`     // no-wait 如果设置为 true，不等待服务器的确认。
+	Arguments amqp.Table `mapstructure:"arguments"`   // arguments Table 类型，表示一个键值对的字典，用于指定队列的额外参数。和下面的字段对应同一个参数时优先使用Arguments。
 
-	BindNoWait bool       // no-wait 如果设置为 true，不等待服务器的确认。
-	BindArgs   amqp.Table // arguments Table 类型，表示一个键值对的字典，用于指定绑定的额外参数。
+	Type                 QueueType     `mapstructure:"type"`                    // x-queue-type 队列类型 classic|quorum|stream，为空时使用broker的默认类型
+	MaxLength            int           `mapstructure:"max_length"`              // x-max-length 最大消息数量，为0时不限制
+	MaxLengthBytes       int64         `mapstructure:"max_length_bytes"`        // x-max-length-bytes 所有消息body的最大字节数，为0时不限制
+	Overflow             QueueOverflow `mapstructure:"overflow"`                // x-overflow 达到最大长度时的处理方式 drop-head|reject-publish|reject-publish-dlx
+	MessageTTL           time.Duration `mapstructure:"message_ttl"`             // x-message-ttl 消息在队列中的过期时间，精度为毫秒，为0时不过期
+	DeadLetterExchange   string        `mapstructure:"dead_letter_exchange"`    // x-dead-letter-exchange 死信exchange，配置了Retry时使用Retry的死信队列
+	DeadLetterRoutingKey string        `mapstructure:"dead_letter_routing_key"` // x-dead-letter-routing-key 死信routing key，为空时使用消息原来的routing key
+	SingleActiveConsumer bool          `mapstructure:"single_active_consumer"`  // x-single-active-consumer 同一时间只有一个消费者接收消息，其他消费者作为备用
+
+	BindNoWait bool       `mapstructure:"bind_no_wait"`   // no-wait 如果设置为 true，不等待服务器的确认。
+	BindArgs   amqp.Table `mapstructure:"bind_arguments"` // arguments Table 类型，表示一个键值对的字典，用于指定绑定的额外参数。
+
+	Retry *RetryOptions `mapstructure:"retry"` // retry 非空时，HandlerFunc返回error的消息延迟重试，超过最大次数后进入死信队列。需要指定队列名称。
 }
 
 type ConsumeOptions struct {
@@ -59,22 +104,26 @@ type ConsumeOptions struct {
 	NoLocal   bool       // no-local 如果设置为 true，表示不能将同一个connection中发送的消息传送给这个connection中的消费者。
 	NoWait    bool       // no-wait 如果设置为 true，不等待服务器的确认。
 	Arguments amqp.Table // arguments Table 类型，表示一个键值对的字典，用于指定消费者的额外参数。
+
+	StreamOffset StreamOffset // 消费stream队列时开始的位置，为空时只消费之后写入的消息
+
+	NackPolicy NackPolicy // HandlerFunc返回error或panic时的处理方式，默认NackRequeue
+
+	Prefetch    int // prefetch 该消费者最多未ack的消息数量(qos)，为0时不限制
+	Concurrency int // concurrency 处理消息的goroutine数量，默认为1
 }
 
+type NackPolicy int
+
+const (
+	NackRequeue NackPolicy = iota // nack并重新入队
+	NackDiscard                   // nack不重新入队，队列配置了死信exchange时进入死信队列
+)
+
+// MessageHandlerFunc 需要handler自己ack/nack消息
 type MessageHandlerFunc func(msg amqp.Delivery)
 
-func messageHandler(ctx context.Context, msgs <-chan amqp.Delivery, handler MessageHandlerFunc) {
-	for {
-		select {
-		case msg, ok := <-msgs:
-			if !ok {
-				log.Printf("Channel closed\n")
-				return
-			}
-			handler(msg)
-		case <-ctx.Done():
-			log.Printf("done,quit")
-			return
-		}
-	}
-}
+// HandlerFunc handler返回nil时ack消息，返回error或者panic时根据ConsumeOptions.NackPolicy nack消息
+// 可以用Requeue(err)或Discard(err)包装返回的error来覆盖NackPolicy
+// ConsumeOptions.AutoAck为true时不做ack/nack
+type HandlerFunc func(ctx context.Context, msg amqp.Delivery) error